@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Grantee URIs of the predefined groups which make an object public
+const (
+	allUsersURI           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	authenticatedUsersURI = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
+
+// OwnedBy reports whether an object's owner, as returned by a listing with
+// FetchOwner set, matches a canonical user ID or display name
+func OwnedBy(obj ObjectInfo, owner string) bool {
+	return obj.OwnerID == owner || obj.OwnerName == owner
+}
+
+// IsPublic reports whether an object's ACL grants read access to everyone
+// or to any authenticated AWS user
+func (mj *MatchJob) IsPublic(ctx context.Context, key string) (bool, error) {
+	acl, err := mj.Context.S3.GetObjectAclWithContext(ctx, &s3.GetObjectAclInput{
+		Bucket: aws.String(*mj.Context.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, grant := range acl.Grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		switch aws.StringValue(grant.Grantee.URI) {
+		case allUsersURI, authenticatedUsersURI:
+			switch aws.StringValue(grant.Permission) {
+			case s3.PermissionRead, s3.PermissionFullControl:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// deleteBatchSize is the most keys a single DeleteObjects request accepts
+const deleteBatchSize = 1000
+
+// Action is a change applied to each object with at least one match. With
+// DryRun set the changes are only described. Rate limits the number of
+// requests made per second
+type Action struct {
+	Delete   bool
+	TagKey   string
+	TagValue string
+	DryRun   bool
+	Rate     float64
+}
+
+// ParseAction parses an -action argument, either delete or tag:key=value
+func ParseAction(spec string) (*Action, error) {
+	if spec == "delete" {
+		return &Action{Delete: true}, nil
+	}
+	if strings.HasPrefix(spec, "tag:") {
+		tag := strings.SplitN(strings.TrimPrefix(spec, "tag:"), "=", 2)
+		if len(tag) == 2 && tag[0] != "" {
+			return &Action{TagKey: tag[0], TagValue: tag[1]}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid action %q, expected delete or tag:key=value", spec)
+}
+
+// NewAction parses an -action argument, refusing an action which would
+// modify objects unless confirm is set. A dry run modifies nothing, so needs
+// no confirmation
+func NewAction(spec string, confirm, dryRun bool, rate float64) (*Action, error) {
+	action, err := ParseAction(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !confirm && !dryRun {
+		return nil, errors.New("-action modifies objects, so requires -confirm (or -dry-run)")
+	}
+	action.DryRun = dryRun
+	action.Rate = rate
+	return action, nil
+}
+
+// ApplyAction applies the job's action to the given keys in its bucket,
+// returning a description of each failure
+func (mj *MatchJob) ApplyAction(ctx context.Context, keys []string) []string {
+	var failures []string
+	interval := time.Second
+	if mj.Action.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / mj.Action.Rate)
+	}
+	limiter := time.NewTicker(interval)
+	defer limiter.Stop()
+	wait := func() bool {
+		select {
+		case <-limiter.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if mj.Action.Delete {
+		for start := 0; start < len(keys); start += deleteBatchSize {
+			end := start + deleteBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if mj.Action.DryRun {
+				for _, key := range keys[start:end] {
+					mj.Progress.Logf("%s: would delete\n", mj.safe(mj.DisplayKey(key)))
+				}
+				continue
+			}
+			if !wait() {
+				return append(failures, ctx.Err().Error())
+			}
+			failures = append(failures, mj.deleteObjects(ctx, keys[start:end])...)
+		}
+		return failures
+	}
+	for _, key := range keys {
+		if mj.Action.DryRun {
+			mj.Progress.Logf("%s: would tag %s=%s\n", mj.safe(mj.DisplayKey(key)), mj.Action.TagKey, mj.Action.TagValue)
+			continue
+		}
+		if !wait() {
+			return append(failures, ctx.Err().Error())
+		}
+		if err := mj.tagObject(ctx, key); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", mj.DisplayKey(key), err))
+			continue
+		}
+		mj.Progress.Logf("%s: tagged %s=%s\n", mj.safe(mj.DisplayKey(key)), mj.Action.TagKey, mj.Action.TagValue)
+	}
+	return failures
+}
+
+// deleteObjects deletes a batch of keys with a single request
+func (mj *MatchJob) deleteObjects(ctx context.Context, keys []string) []string {
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	resp, err := mj.Context.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(*mj.Context.Bucket),
+		Delete: &s3.Delete{Objects: objects},
+	})
+	if err != nil {
+		failures := make([]string, len(keys))
+		for i, key := range keys {
+			failures[i] = fmt.Sprintf("%s: %v", mj.DisplayKey(key), err)
+		}
+		return failures
+	}
+	for _, deleted := range resp.Deleted {
+		mj.Progress.Logf("%s: deleted\n", mj.safe(mj.DisplayKey(aws.StringValue(deleted.Key))))
+	}
+	var failures []string
+	for _, failed := range resp.Errors {
+		failures = append(failures, fmt.Sprintf("%s: %s", mj.DisplayKey(aws.StringValue(failed.Key)), aws.StringValue(failed.Message)))
+	}
+	return failures
+}
+
+// tagObject adds the action's tag to an object, preserving its other tags
+func (mj *MatchJob) tagObject(ctx context.Context, key string) error {
+	current, err := mj.Context.S3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(*mj.Context.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	tags := []*s3.Tag{{Key: aws.String(mj.Action.TagKey), Value: aws.String(mj.Action.TagValue)}}
+	for _, tag := range current.TagSet {
+		if aws.StringValue(tag.Key) != mj.Action.TagKey {
+			tags = append(tags, tag)
+		}
+	}
+	_, err = mj.Context.S3.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(*mj.Context.Bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tags},
+	})
+	return err
+}
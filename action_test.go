@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// recordingS3 records the deletes and tag changes requested of it
+type recordingS3 struct {
+	s3iface.S3API
+	mutations []string
+}
+
+func (rs *recordingS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	output := &s3.DeleteObjectsOutput{}
+	for _, obj := range input.Delete.Objects {
+		rs.mutations = append(rs.mutations, "delete "+aws.StringValue(obj.Key))
+		output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: obj.Key})
+	}
+	return output, nil
+}
+
+func (rs *recordingS3) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	return &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{{Key: aws.String("owner"), Value: aws.String("ops")}}}, nil
+}
+
+func (rs *recordingS3) PutObjectTaggingWithContext(ctx aws.Context, input *s3.PutObjectTaggingInput, opts ...request.Option) (*s3.PutObjectTaggingOutput, error) {
+	var tags []string
+	for _, tag := range input.Tagging.TagSet {
+		tags = append(tags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+	}
+	rs.mutations = append(rs.mutations, "tag "+aws.StringValue(input.Key)+" "+strings.Join(tags, ","))
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func TestAction(t *testing.T) {
+	source := memSource{
+		"a.log": "hit\n",
+		"b.log": "miss\n",
+		"c.log": "hit\n",
+	}
+	tests := []struct {
+		name      string
+		spec      string
+		confirm   bool
+		dryRun    bool
+		refused   bool
+		mutations string
+		log       string
+	}{
+		{"delete unconfirmed", "delete", false, false, true, "", ""},
+		{"tag unconfirmed", "tag:reviewed=true", false, false, true, "", ""},
+		{"delete dry run", "delete", false, true, false, "", "a.log: would delete\nc.log: would delete\n"},
+		{"tag dry run", "tag:reviewed=true", false, true, false, "",
+			"a.log: would tag reviewed=true\nc.log: would tag reviewed=true\n"},
+		{"confirmed dry run", "delete", true, true, false, "", "a.log: would delete\nc.log: would delete\n"},
+		{"delete", "delete", true, false, false, "delete a.log|delete c.log", "a.log: deleted\nc.log: deleted\n"},
+		{"tag", "tag:reviewed=true", true, false, false,
+			"tag a.log reviewed=true,owner=ops|tag c.log reviewed=true,owner=ops",
+			"a.log: tagged reviewed=true\nc.log: tagged reviewed=true\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := NewAction(tt.spec, tt.confirm, tt.dryRun, 1000)
+			if tt.refused {
+				if err == nil {
+					t.Error("unconfirmed action accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stub := &recordingS3{}
+			mj, _ := newTestJob(source, "hit")
+			mj.Context.S3 = stub
+			mj.Action = action
+			var log bytes.Buffer
+			mj.Progress = NewProgress(&log, false)
+			mj.QuietErrors = true
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(summary.Errors) > 0 {
+				t.Errorf("errors %q", summary.Errors)
+			}
+			if got := strings.Join(stub.mutations, "|"); got != tt.mutations {
+				t.Errorf("mutations %q, want %q", got, tt.mutations)
+			}
+			var actions []string
+			for _, line := range strings.SplitAfter(log.String(), "\n") {
+				if strings.Contains(line, "delete") || strings.Contains(line, "tag") {
+					actions = append(actions, line)
+				}
+			}
+			if got := strings.Join(actions, ""); got != tt.log {
+				t.Errorf("logged %q, want %q", got, tt.log)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageSuffix marks objects encrypted with age
+const ageSuffix = ".age"
+
+// ReadAgeIdentities reads the age identities in a file, such as one written
+// by age-keygen
+func ReadAgeIdentities(filename string) ([]age.Identity, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return identities, nil
+}
+
+// DecryptAge decrypts an object body if its key ends in .age and
+// AgeIdentities are configured, returning the body along with the key the
+// object would have unencrypted, so that any inner compression is still
+// recognised from its extension. Other objects are returned unchanged
+func (mj *MatchJob) DecryptAge(key string, body io.ReadCloser) (string, io.ReadCloser, error) {
+	if len(mj.AgeIdentities) == 0 || !strings.HasSuffix(key, ageSuffix) {
+		return key, body, nil
+	}
+	decrypted, err := age.Decrypt(body, mj.AgeIdentities...)
+	if err != nil {
+		return key, nil, fmt.Errorf("decrypting: %v", err)
+	}
+	return strings.TrimSuffix(key, ageSuffix), ioutil.NopCloser(decrypted), nil
+}
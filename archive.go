@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Archive formats recognised by ArchiveFormat
+const (
+	archiveTar = "tar"
+	archiveZip = "zip"
+)
+
+// ArchiveFormat returns the archive format implied by a key's extension, or
+// an empty string if the key does not name an archive. Compressed tarballs
+// are reported as tar, as TransparentExpandingReader removes the compression
+func ArchiveFormat(key string) string {
+	lower := strings.ToLower(key)
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2"} {
+		if strings.HasSuffix(lower, suffix) {
+			return archiveTar
+		}
+	}
+	if strings.HasSuffix(lower, ".zip") {
+		return archiveZip
+	}
+	return ""
+}
+
+// SearchArchive searches each regular file in an archive whose name matches
+// MemberMatch, returning the total number of matches. Members are shown as
+// key{member}, and are themselves decompressed according to their names
+func (mj *MatchJob) SearchArchive(obj ObjectInfo, format string, reader io.Reader) (int, error) {
+	if format == archiveZip {
+		return mj.searchZip(obj, reader)
+	}
+	archive := tar.NewReader(reader)
+	total := 0
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		matches, err := mj.searchMember(obj, header.Name, header.Size, archive)
+		total += matches
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// searchZip searches the members of a zip archive. The zip format keeps its
+// index at the end of the file, so the archive is first held in memory if
+// it fits in the buffer budget, or else spooled to a temporary file in
+// SpoolDir, which is removed once the search is complete
+func (mj *MatchJob) searchZip(obj ObjectInfo, reader io.Reader) (int, error) {
+	content, size, cleanup, err := mj.Buffers.Spool(mj.SpoolDir, reader)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+	archive, err := zip.NewReader(content, size)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, file := range archive.File {
+		if !file.Mode().IsRegular() || !mj.MemberMatch.MatchString(file.Name) {
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			return total, err
+		}
+		matches, err := mj.searchMember(obj, file.Name, int64(file.UncompressedSize64), content)
+		content.Close()
+		total += matches
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// spool copies a stream to a new temporary file in dir, or the system
+// temporary directory if dir is empty, returning the file and its size. The
+// caller must close and remove the file
+func spool(dir string, reader io.Reader) (*os.File, int64, error) {
+	file, err := ioutil.TempFile(dir, "s3multigrep-")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// searchMember matches the content of a single archive member. Members too
+// large for multiline matching or the buffer budget are skipped without
+// abandoning the archive
+func (mj *MatchJob) searchMember(obj ObjectInfo, name string, size int64, reader io.Reader) (int, error) {
+	if !mj.MemberMatch.MatchString(name) {
+		return 0, nil
+	}
+	member := obj
+	member.Key = obj.Key + "{" + name + "}"
+	member.Size = size
+	expanded, err := TransparentExpandingReader(name, ioutil.NopCloser(reader))
+	if err != nil {
+		return 0, err
+	}
+	matches, err := mj.MatchContent(member, expanded)
+	if err == errMultilineTooLarge || err == ErrBufferBudget {
+		mj.Warnf(member.Key, "skipped, %v", err)
+		return matches, nil
+	}
+	return matches, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ParseLevels parses a comma-separated list of positive concurrency levels
+func ParseLevels(value string) ([]int, error) {
+	var levels []int
+	for _, field := range strings.Split(value, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || level < 1 {
+			return nil, fmt.Errorf("invalid concurrency level %q", field)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// benchmarkObject is a sampled object along with the job for its bucket
+type benchmarkObject struct {
+	job *MatchJob
+	obj ObjectInfo
+}
+
+// Benchmark searches the first limit selected objects once at each
+// concurrency level, discarding matches, and reports the throughput of each
+// run so that a suitable -concurrency can be chosen. Later runs may benefit
+// from caching between here and the object store, so levels are best given
+// more than once or in varying order. Buckets which cannot be listed are
+// reported and the objects listed from the rest are benchmarked, after
+// which an error is returned
+func (mj *MatchJob) Benchmark(ctx context.Context, levels []int, limit int) error {
+	base := *mj
+	base.Output = NewOutput(ioutil.Discard, 4096)
+	base.Progress = NewProgress(ioutil.Discard, false)
+	base.MaxLines = 0
+	base.MaxTotalBytes = 0
+	base.Action = nil
+	var sample []benchmarkObject
+	var sampleBytes int64
+	buckets := mj.Context.Buckets()
+	failed := 0
+	for _, bucket := range buckets {
+		job := base.ForBucket(bucket)
+		listCtx, cancel := context.WithCancel(ctx)
+		listed := true
+		for obj := range job.ListObjects(listCtx, job.ObjectSource()) {
+			if obj.Err != nil {
+				listed = mj.listingFailed(ctx, bucket, obj.Err) && listed
+				continue
+			}
+			if len(sample) == limit {
+				break
+			}
+			if job.WantObject(obj) && !job.TooLarge(obj) {
+				sample = append(sample, benchmarkObject{job: job, obj: obj})
+				sampleBytes += obj.Size
+			}
+		}
+		cancel()
+		if !listed {
+			failed++
+		}
+	}
+	fmt.Printf("benchmarking %d objects, %d MB\n", len(sample), sampleBytes/1048576)
+	for _, level := range levels {
+		if ctx.Err() != nil {
+			return nil
+		}
+		scanned := atomic.LoadInt64(mj.scanned)
+		start := time.Now()
+		errors := mj.benchmarkRun(ctx, sample, level)
+		elapsed := time.Since(start)
+		decompressed := atomic.LoadInt64(mj.scanned) - scanned
+		fmt.Printf("concurrency %d: %s, %.1f objects/s, %.1f MB/s stored, %.1f MB/s decompressed, %d errors\n",
+			level, elapsed.Round(time.Millisecond), float64(len(sample))/elapsed.Seconds(),
+			float64(sampleBytes)/1048576/elapsed.Seconds(), float64(decompressed)/1048576/elapsed.Seconds(), errors)
+	}
+	return bucketsFailed(failed, len(buckets))
+}
+
+// benchmarkRun searches every sampled object using the given number of
+// workers, returning the number of objects which failed
+func (mj *MatchJob) benchmarkRun(ctx context.Context, sample []benchmarkObject, workers int) int {
+	objects := make(chan benchmarkObject)
+	var errors int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range objects {
+				if result := item.job.searchListed(ctx, item.obj); result.Err != nil {
+					atomic.AddInt64(&errors, 1)
+				}
+			}
+		}()
+	}
+	for _, item := range sample {
+		objects <- item
+	}
+	close(objects)
+	wg.Wait()
+	return int(errors)
+}
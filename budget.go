@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrBufferBudget is returned when buffering an object in memory would take
+// concurrent buffers past the -max-buffer-bytes budget
+var ErrBufferBudget = errors.New("would exceed -max-buffer-bytes")
+
+// bufferChunkSize is the granularity at which buffered reads claim budget
+const bufferChunkSize = 65536
+
+// BufferBudget limits the memory held by objects buffered concurrently for
+// multiline and parallel matching and zip archives. A nil BufferBudget is
+// unlimited
+type BufferBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// NewBufferBudget creates a budget of limit bytes
+func NewBufferBudget(limit int64) *BufferBudget {
+	return &BufferBudget{limit: limit}
+}
+
+// Reserve claims n bytes of the budget, reporting false if there is not
+// enough left
+func (bb *BufferBudget) Reserve(n int64) bool {
+	if bb == nil {
+		return true
+	}
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if bb.used+n > bb.limit {
+		return false
+	}
+	bb.used += n
+	return true
+}
+
+// Release returns n bytes to the budget
+func (bb *BufferBudget) Release(n int64) {
+	if bb == nil {
+		return
+	}
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	bb.used -= n
+}
+
+// buffer reads a stream into memory, claiming budget as it goes, until the
+// stream ends or the budget runs out. If it runs out, the bytes last read
+// are returned unclaimed as rest. The claim is kept for the caller to
+// release, except on a read error
+func (bb *BufferBudget) buffer(reader io.Reader) (data, rest []byte, reserved int64, err error) {
+	var buffer bytes.Buffer
+	chunk := make([]byte, bufferChunkSize)
+	for {
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			if !bb.Reserve(int64(n)) {
+				return buffer.Bytes(), chunk[:n], reserved, nil
+			}
+			reserved += int64(n)
+			buffer.Write(chunk[:n])
+		}
+		if err == io.EOF {
+			return buffer.Bytes(), nil, reserved, nil
+		}
+		if err != nil {
+			bb.Release(reserved)
+			return nil, nil, 0, err
+		}
+	}
+}
+
+// ReadAll reads a stream into memory, claiming budget as it goes. The
+// returned function releases the claim once the data is no longer needed.
+// If the budget runs out, everything claimed so far is released and
+// ErrBufferBudget is returned
+func (bb *BufferBudget) ReadAll(reader io.Reader) ([]byte, func(), error) {
+	data, rest, reserved, err := bb.buffer(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rest != nil {
+		bb.Release(reserved)
+		return nil, nil, ErrBufferBudget
+	}
+	return data, func() { bb.Release(reserved) }, nil
+}
+
+// Spool reads a stream for random access, holding it in memory while it
+// fits in the budget and otherwise copying it to a temporary file in dir,
+// or the system temporary directory if dir is empty. A nil BufferBudget
+// always spools to a file, as memory would then be unbounded. The returned
+// function releases the claim or removes the file
+func (bb *BufferBudget) Spool(dir string, reader io.Reader) (io.ReaderAt, int64, func(), error) {
+	if bb != nil {
+		data, rest, reserved, err := bb.buffer(reader)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if rest == nil {
+			return bytes.NewReader(data), int64(len(data)), func() { bb.Release(reserved) }, nil
+		}
+		defer bb.Release(reserved)
+		reader = io.MultiReader(bytes.NewReader(data), bytes.NewReader(rest), reader)
+	}
+	file, size, err := spool(dir, reader)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return file, size, func() {
+		file.Close()
+		os.Remove(file.Name())
+	}, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// zipped archives files, stored uncompressed so that the archive is at
+// least as large as its content
+func zipped(t *testing.T, files map[string]string) string {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, content := range files {
+		file, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(file, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestBufferBudget(t *testing.T) {
+	const limit = 4 * bufferChunkSize
+	content := strings.Repeat("x", limit/2)
+	budget := NewBufferBudget(limit)
+	data, release, err := budget.ReadAll(strings.NewReader(content))
+	if err != nil || string(data) != content {
+		t.Fatalf("ReadAll within budget: %d bytes, %v", len(data), err)
+	}
+	if _, _, err := budget.ReadAll(strings.NewReader(content + content)); err != ErrBufferBudget {
+		t.Errorf("ReadAll past budget: %v, want %v", err, ErrBufferBudget)
+	}
+	if budget.used != limit/2 {
+		t.Errorf("after failed ReadAll %d bytes used, want %d", budget.used, limit/2)
+	}
+	release()
+
+	tests := []struct {
+		name   string
+		budget *BufferBudget
+		size   int
+		file   bool
+	}{
+		{"within budget", budget, limit, false},
+		{"past budget", budget, limit + 1, true},
+		{"unlimited", nil, limit, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "spool")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			content := strings.Repeat("0123456789", tt.size/10+1)[:tt.size]
+			spooled, size, cleanup, err := tt.budget.Spool(dir, strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, size)
+			if _, err := spooled.ReadAt(got, 0); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if string(got) != content {
+				t.Errorf("spooled %d bytes differ from the %d read", size, len(content))
+			}
+			files, _ := ioutil.ReadDir(dir)
+			if file := len(files) == 1; file != tt.file {
+				t.Errorf("spooled to a file %v, want %v", file, tt.file)
+			}
+			if used := int64(tt.size); tt.budget != nil && !tt.file && tt.budget.used != used {
+				t.Errorf("%d bytes used while held in memory, want %d", tt.budget.used, used)
+			}
+			cleanup()
+			if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+				t.Errorf("%d files left after cleanup", len(files))
+			}
+			if tt.budget != nil && tt.budget.used != 0 {
+				t.Errorf("%d bytes used after cleanup", tt.budget.used)
+			}
+		})
+	}
+}
+
+func TestSearchBufferBudget(t *testing.T) {
+	const limit = 2 * parallelChunkSize
+	large := strings.Repeat("filler line\n", 3*limit/12) + "hit\n"
+	tests := []struct {
+		name     string
+		source   memSource
+		setup    func(mj *MatchJob)
+		want     string
+		warnings int
+	}{
+		{
+			"multiline",
+			memSource{"a.log": "one\nhit\n", "b.log": large},
+			func(mj *MatchJob) { mj.SetMultiline(int64(len(large))) },
+			"hit\n",
+			1,
+		},
+		{
+			"zip spooled past budget",
+			memSource{"a.zip": zipped(t, map[string]string{"a.log": large})},
+			func(mj *MatchJob) {},
+			"hit\n",
+			0,
+		},
+		{
+			"parallel within budget",
+			memSource{"a.log": strings.Repeat("filler line\n", parallelChunkSize/12+1) + "hit\n"},
+			func(mj *MatchJob) { mj.MatchWorkers = 2 },
+			"hit\n",
+			0,
+		},
+		{
+			"parallel past budget",
+			memSource{"a.log": "hit\n" + large},
+			func(mj *MatchJob) { mj.MatchWorkers = 4 },
+			"hit\n",
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(tt.source, "hit")
+			mj.Buffers = NewBufferBudget(limit)
+			tt.setup(mj)
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			if summary.Warnings != tt.warnings {
+				t.Errorf("%d warnings, want %d", summary.Warnings, tt.warnings)
+			}
+			if mj.Buffers.used != 0 {
+				t.Errorf("%d bytes still used after searching", mj.Buffers.used)
+			}
+		})
+	}
+}
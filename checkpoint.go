@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Checkpoint persists the list continuation token of a search to a file, so
+// that a search of a very large bucket can resume where a previous run
+// stopped
+type Checkpoint struct {
+	Filename string
+}
+
+// Load returns the saved continuation token, or an empty string if there is
+// no checkpoint yet
+func (c *Checkpoint) Load() (string, error) {
+	data, err := ioutil.ReadFile(c.Filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Save records the token of the next page to be listed. A nil token means
+// listing is complete, so the checkpoint is removed
+func (c *Checkpoint) Save(token *string) error {
+	if token == nil {
+		err := os.Remove(c.Filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(c.Filename, []byte(*token+"\n"), 0644)
+}
+
+// pageEnd marks the end of a listed page: the number of objects listed up
+// to and including the page, and the token for the page after it
+type pageEnd struct {
+	listed int64
+	next   *string
+}
+
+// CheckpointTracker saves the token for the next page only once every
+// object of the pages before it has been searched, so that a resumed search
+// does not skip objects which were listed but still queued or in progress.
+// Objects are identified by their 0-based position in the listing
+type CheckpointTracker struct {
+	Checkpoint *Checkpoint
+	mu         sync.Mutex
+	done       map[int64]bool
+	finished   int64
+	pages      []pageEnd
+}
+
+// NewCheckpointTracker creates a tracker saving to checkpoint
+func NewCheckpointTracker(checkpoint *Checkpoint) *CheckpointTracker {
+	return &CheckpointTracker{Checkpoint: checkpoint, done: map[int64]bool{}}
+}
+
+// PageListed records that a page ends once listed objects have been listed,
+// with next the token of the following page, nil after the last page
+func (ct *CheckpointTracker) PageListed(listed int64, next *string) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.pages = append(ct.pages, pageEnd{listed: listed, next: next})
+	return ct.save()
+}
+
+// Finished records that the object at a position in the listing has been
+// searched, skipped or has failed
+func (ct *CheckpointTracker) Finished(position int64) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.done[position] = true
+	for ct.done[ct.finished] {
+		delete(ct.done, ct.finished)
+		ct.finished++
+	}
+	return ct.save()
+}
+
+// save writes the token following the last page whose objects have all
+// finished, if that has changed
+func (ct *CheckpointTracker) save() error {
+	completed := 0
+	for completed < len(ct.pages) && ct.pages[completed].listed <= ct.finished {
+		completed++
+	}
+	if completed == 0 {
+		return nil
+	}
+	next := ct.pages[completed-1].next
+	ct.pages = ct.pages[completed:]
+	return ct.Checkpoint.Save(next)
+}
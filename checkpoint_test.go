@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	server := fakeS3(t, map[string]s3Page{
+		"":   {keys: []string{"a.log", "b.log"}, next: "t1"},
+		"t1": {keys: []string{"c.log", "d.log"}, next: "t2"},
+		"t2": {keys: []string{"e.log"}},
+	})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"from the start", "", "a.log\nb.log\nc.log\nd.log\ne.log\n"},
+		{"from a saved token", "t1", "c.log\nd.log\ne.log\n"},
+		{"from the last page", "t2", "e.log\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkpoint := &Checkpoint{Filename: filepath.Join(dir, "checkpoint")}
+			if tt.token != "" {
+				if err := checkpoint.Save(aws.String(tt.token)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mj, output := newTestJob(nil, "log")
+			mj.Context.S3 = fakeS3Client(server)
+			mj.Checkpoint = checkpoint
+			if _, err := mj.Search(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("searched %q, want %q", got, tt.want)
+			}
+			if _, err := os.Stat(checkpoint.Filename); !os.IsNotExist(err) {
+				t.Errorf("checkpoint remains after a complete search: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckpointTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// two pages of two objects each, followed by a final page of one
+	tests := []struct {
+		name     string
+		finished []int64
+		want     string
+	}{
+		{"nothing finished", nil, ""},
+		{"first page partly finished", []int64{0}, ""},
+		{"later object finished first", []int64{1, 2, 3}, ""},
+		{"first page finished", []int64{1, 0}, "t1"},
+		{"first page finished out of order", []int64{3, 1, 0}, "t1"},
+		{"two pages finished", []int64{3, 2, 1, 0}, "t2"},
+		{"every page finished", []int64{4, 3, 2, 1, 0}, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkpoint := &Checkpoint{Filename: filepath.Join(dir, "checkpoint")}
+			defer os.Remove(checkpoint.Filename)
+			tracker := NewCheckpointTracker(checkpoint)
+			pages := []pageEnd{{2, aws.String("t1")}, {4, aws.String("t2")}, {5, nil}}
+			for _, page := range pages {
+				if err := tracker.PageListed(page.listed, page.next); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, position := range tt.finished {
+				if err := tracker.Finished(position); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, statErr := os.Stat(checkpoint.Filename)
+			got, err := checkpoint.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "none" {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("checkpoint not removed, holds %q", got)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("saved token %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Checksum algorithms accepted by -checksum
+const (
+	checksumETag   = "etag"
+	checksumCRC32  = "crc32"
+	checksumCRC32C = "crc32c"
+	checksumSHA1   = "sha1"
+	checksumSHA256 = "sha256"
+)
+
+// ChecksumFilter selects objects whose checksum equals, or with Exclude set
+// differs from, an expected value
+type ChecksumFilter struct {
+	Algorithm string
+	Value     string
+	Exclude   bool
+}
+
+// ParseChecksumFilter parses a -checksum argument of the form
+// [!][algorithm:]value. The algorithm is one of etag, the default, crc32,
+// crc32c, sha1 or sha256, and a leading ! selects objects whose checksum
+// differs from the value
+func ParseChecksumFilter(spec string) (*ChecksumFilter, error) {
+	cf := &ChecksumFilter{Algorithm: checksumETag}
+	if strings.HasPrefix(spec, "!") {
+		cf.Exclude = true
+		spec = spec[1:]
+	}
+	if i := strings.Index(spec, ":"); i >= 0 {
+		cf.Algorithm = strings.ToLower(spec[:i])
+		spec = spec[i+1:]
+	}
+	switch cf.Algorithm {
+	case checksumETag:
+		spec = strings.ToLower(strings.Trim(spec, `"`))
+	case checksumCRC32, checksumCRC32C, checksumSHA1, checksumSHA256:
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q", cf.Algorithm)
+	}
+	if spec == "" {
+		return nil, fmt.Errorf("checksum value is required")
+	}
+	cf.Value = spec
+	return cf, nil
+}
+
+// Listed reports whether the filter applies to listing metadata, rather
+// than needing a HEAD request for each object
+func (cf *ChecksumFilter) Listed() bool {
+	return cf.Algorithm == checksumETag
+}
+
+// Matches reports whether a checksum satisfies the filter. An object
+// without a checksum of the filter's algorithm is treated as differing
+func (cf *ChecksumFilter) Matches(checksum string) bool {
+	return (checksum == cf.Value) != cf.Exclude
+}
+
+// ObjectChecksum fetches the base64 checksum an object was uploaded with,
+// returning an empty string if it has none of the given algorithm
+func (mj *MatchJob) ObjectChecksum(ctx context.Context, key, algorithm string) (string, error) {
+	head, err := mj.Context.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(*mj.Context.Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return "", err
+	}
+	switch algorithm {
+	case checksumCRC32:
+		return aws.StringValue(head.ChecksumCRC32), nil
+	case checksumCRC32C:
+		return aws.StringValue(head.ChecksumCRC32C), nil
+	case checksumSHA1:
+		return aws.StringValue(head.ChecksumSHA1), nil
+	case checksumSHA256:
+		return aws.StringValue(head.ChecksumSHA256), nil
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %q", algorithm)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Backends accepted by -backend
+const (
+	backendS3    = "s3"
+	backendGCS   = "gcs"
+	backendAzure = "azure"
+)
+
+// httpGet performs an authenticated GET, returning the body of a successful
+// response along with its Content-Encoding and Content-Type. Any other
+// status is reported as an error including the start of the response body
+func httpGet(ctx context.Context, client *http.Client, location string, header http.Header) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: %s: %s", req.URL.Path, resp.Status, detail)
+	}
+	return &objectBody{
+		ReadCloser:  resp.Body,
+		encoding:    resp.Header.Get("Content-Encoding"),
+		contentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+// gcsScope is the OAuth scope requested for GCS, which is only ever read
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// GCSTokenSource returns the source of OAuth tokens for GCS requests. A
+// token in GOOGLE_OAUTH_ACCESS_TOKEN, such as the output of gcloud auth
+// print-access-token, is used as is. Otherwise Application Default
+// Credentials are used, from GOOGLE_APPLICATION_CREDENTIALS, gcloud auth
+// application-default login or the metadata server, and tokens are
+// refreshed as they expire. Tokens are fetched with the HTTP client in ctx
+func GCSTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+	}
+	credentials, err := google.FindDefaultCredentials(ctx, gcsScope)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.TokenSource, nil
+}
+
+// GCSSource lists and fetches the objects of a Google Cloud Storage bucket
+// using the JSON API at Endpoint. Client is expected to authenticate
+// requests, as set up by Connect
+type GCSSource struct {
+	Client   *http.Client
+	Bucket   string
+	Endpoint string
+}
+
+// NewGCSSource creates a GCSSource for the public GCS endpoint, or for the
+// emulator at STORAGE_EMULATOR_HOST if set, as Google's own clients do
+func NewGCSSource(client *http.Client, bucket string) *GCSSource {
+	endpoint := "https://storage.googleapis.com"
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = host
+		if !strings.Contains(host, "://") {
+			endpoint = "http://" + host
+		}
+	}
+	return &GCSSource{Client: client, Bucket: bucket, Endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+// gcsObjectList is a page of the GCS objects.list response
+type gcsObjectList struct {
+	Items []struct {
+		Name         string    `json:"name"`
+		Size         string    `json:"size"`
+		Updated      time.Time `json:"updated"`
+		StorageClass string    `json:"storageClass"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// List implements ObjectSource
+func (gs *GCSSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		token := ""
+		for {
+			query := url.Values{"prefix": {prefix}, "fields": {"items(name,size,updated,storageClass),nextPageToken"}}
+			if token != "" {
+				query.Set("pageToken", token)
+			}
+			page, err := gs.listPage(ctx, query)
+			if err != nil {
+				sendObject(ctx, objects, ObjectInfo{Err: err})
+				return
+			}
+			for _, item := range page.Items {
+				size, _ := strconv.ParseInt(item.Size, 10, 64)
+				obj := ObjectInfo{Key: item.Name, Size: size, LastModified: item.Updated, StorageClass: item.StorageClass}
+				if !sendObject(ctx, objects, obj) {
+					return
+				}
+			}
+			if page.NextPageToken == "" {
+				return
+			}
+			token = page.NextPageToken
+		}
+	}()
+	return objects
+}
+
+// listPage fetches a single page of an objects.list request
+func (gs *GCSSource) listPage(ctx context.Context, query url.Values) (*gcsObjectList, error) {
+	location := gs.Endpoint + "/storage/v1/b/" + url.PathEscape(gs.Bucket) + "/o?" + query.Encode()
+	body, err := httpGet(ctx, gs.Client, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	page := &gcsObjectList{}
+	if err := json.NewDecoder(body).Decode(page); err != nil {
+		return nil, fmt.Errorf("listing gs://%s: %v", gs.Bucket, err)
+	}
+	return page, nil
+}
+
+// Get implements ObjectSource
+func (gs *GCSSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	location := gs.Endpoint + "/storage/v1/b/" + url.PathEscape(gs.Bucket) + "/o/" + url.PathEscape(key) + "?alt=media"
+	return httpGet(ctx, gs.Client, location, nil)
+}
+
+// AzureSource lists and fetches the blobs of an Azure Blob Storage
+// container. SAS is a shared access signature query string appended to
+// every request; without one only public containers can be read
+type AzureSource struct {
+	Client    *http.Client
+	Account   string
+	Container string
+	SAS       string
+}
+
+// NewAzureSource creates an AzureSource for a container, taking the storage
+// account and SAS token from the AZURE_STORAGE_ACCOUNT and
+// AZURE_STORAGE_SAS_TOKEN environment variables
+func NewAzureSource(client *http.Client, container string) *AzureSource {
+	return &AzureSource{
+		Client:    client,
+		Account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		Container: container,
+		SAS:       os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+	}
+}
+
+// url builds a request URL for a path within the account, adding the SAS
+// token to the given query
+func (as *AzureSource) url(path string, query url.Values) string {
+	location := "https://" + as.Account + ".blob.core.windows.net/" + path
+	encoded := query.Encode()
+	if sas := trimQuery(as.SAS); sas != "" {
+		if encoded != "" {
+			encoded += "&"
+		}
+		encoded += sas
+	}
+	if encoded != "" {
+		location += "?" + encoded
+	}
+	return location
+}
+
+// trimQuery removes a leading question mark, as SAS tokens are often copied
+// with one
+func trimQuery(query string) string {
+	if len(query) > 0 && query[0] == '?' {
+		return query[1:]
+	}
+	return query
+}
+
+// header returns the headers sent with every Azure request
+func (as *AzureSource) header() http.Header {
+	return http.Header{"X-Ms-Version": {"2020-10-02"}}
+}
+
+// azureBlobList is a page of the List Blobs response
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			ContentLength int64  `xml:"Content-Length"`
+			LastModified  string `xml:"Last-Modified"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List implements ObjectSource
+func (as *AzureSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		marker := ""
+		for {
+			query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+			if marker != "" {
+				query.Set("marker", marker)
+			}
+			page, err := as.listPage(ctx, query)
+			if err != nil {
+				sendObject(ctx, objects, ObjectInfo{Err: err})
+				return
+			}
+			for _, blob := range page.Blobs {
+				modified, _ := time.Parse(time.RFC1123, blob.Properties.LastModified)
+				obj := ObjectInfo{
+					Key:          blob.Name,
+					Size:         blob.Properties.ContentLength,
+					LastModified: modified,
+				}
+				if !sendObject(ctx, objects, obj) {
+					return
+				}
+			}
+			if page.NextMarker == "" {
+				return
+			}
+			marker = page.NextMarker
+		}
+	}()
+	return objects
+}
+
+// listPage fetches a single page of a List Blobs request
+func (as *AzureSource) listPage(ctx context.Context, query url.Values) (*azureBlobList, error) {
+	body, err := httpGet(ctx, as.Client, as.url(url.PathEscape(as.Container), query), as.header())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	page := &azureBlobList{}
+	if err := xml.NewDecoder(body).Decode(page); err != nil {
+		return nil, fmt.Errorf("listing %s/%s: %v", as.Account, as.Container, err)
+	}
+	return page, nil
+}
+
+// Get implements ObjectSource
+func (as *AzureSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path := url.PathEscape(as.Container) + "/" + (&url.URL{Path: key}).EscapedPath()
+	return httpGet(ctx, as.Client, as.url(path, nil), as.header())
+}
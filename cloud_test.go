@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// fakeGCS serves objects through the GCS JSON API, a page of one object at
+// a time, recording the Authorization header of each request
+type fakeGCS struct {
+	objects map[string]string
+	mu      sync.Mutex
+	auth    []string
+}
+
+func (fg *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	fg.auth = append(fg.auth, r.Header.Get("Authorization"))
+	fg.mu.Unlock()
+	const list = "/storage/v1/b/bucket/o"
+	if r.URL.Path != list {
+		body, ok := fg.objects[strings.TrimPrefix(r.URL.Path, list+"/")]
+		if !ok || r.URL.Query().Get("alt") != "media" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+		return
+	}
+	var keys []string
+	for key := range fg.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) && key > r.URL.Query().Get("pageToken") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Fprint(w, `{}`)
+		return
+	}
+	first := keys[0]
+	for _, key := range keys {
+		if key < first {
+			first = key
+		}
+	}
+	next := ""
+	if len(keys) > 1 {
+		next = first
+	}
+	fmt.Fprintf(w, `{"items":[{"name":%q,"size":"%d","updated":"2024-01-01T00:00:00Z"}],"nextPageToken":%q}`,
+		first, len(fg.objects[first]), next)
+}
+
+// fakeTokenServer issues a new short-lived access token for every refresh
+// token grant, numbered from t1
+func fakeTokenServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	issued := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			t.Errorf("unexpected token request %v", r.PostForm)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		issued++
+		token := fmt.Sprintf("t%d", issued)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":1}`, token)
+	}))
+}
+
+func TestGCSSource(t *testing.T) {
+	storage := &fakeGCS{objects: map[string]string{
+		"logs/a.log": "one hit\nmiss\n",
+		"logs/b.gz":  gzipped(t, "two hit\n", 0),
+		"other.log":  "hit elsewhere\n",
+	}}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	tokens := fakeTokenServer(t)
+	defer tokens.Close()
+	dir, err := ioutil.TempDir("", "gcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentials := filepath.Join(dir, "credentials.json")
+	adc := fmt.Sprintf(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh","token_uri":%q}`, tokens.URL)
+	if err := ioutil.WriteFile(credentials, []byte(adc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		token     string
+		anonymous bool
+		auth      string
+	}{
+		{"application default credentials", "", false, "Bearer t1,Bearer t2,Bearer t3,Bearer t4"},
+		{"access token", "fixed", false, "Bearer fixed,Bearer fixed,Bearer fixed,Bearer fixed"},
+		{"anonymous", "", true, ",,,"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{
+				"STORAGE_EMULATOR_HOST":          strings.TrimPrefix(server.URL, "http://"),
+				"GOOGLE_APPLICATION_CREDENTIALS": credentials,
+				"GOOGLE_OAUTH_ACCESS_TOKEN":      tt.token,
+			}
+			for name, value := range env {
+				defer os.Setenv(name, os.Getenv(name))
+				os.Setenv(name, value)
+			}
+			storage.auth = nil
+			mj, output := newTestJob(nil, "hit")
+			mj.Context.Backend = aws.String(backendGCS)
+			mj.Context.Anonymous = aws.Bool(tt.anonymous)
+			mj.Context.ProxyURL = aws.String("")
+			mj.Context.CABundle = aws.String("")
+			mj.Context.Prefixes = PrefixList{"logs/"}
+			mj.ShowKeys = true
+			if err := mj.Context.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := output.String(), "logs/a.log:one hit\nlogs/b.gz:two hit\n"; got != want {
+				t.Errorf("output %q, want %q", got, want)
+			}
+			if len(summary.Errors) > 0 {
+				t.Errorf("errors %q", summary.Errors)
+			}
+			// two list pages and two gets, each with a freshly refreshed token
+			// when using application default credentials
+			sort.Strings(storage.auth)
+			if got := strings.Join(storage.auth, ","); got != tt.auth {
+				t.Errorf("authorization %q, want %q", got, tt.auth)
+			}
+		})
+	}
+}
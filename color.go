@@ -0,0 +1,39 @@
+package main
+
+import "regexp"
+
+// Modes accepted by -color and -safe-output
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// Colorize wraps text in an ANSI SGR escape sequence, such as "1;31" for
+// bold red. An empty code leaves text unchanged
+func Colorize(code, text string) string {
+	if code == "" || text == "" {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// safe applies SafeText to text read from objects, or to a key, if SafeOutput
+// is set. Every such field passes through it before it is written, while
+// the colour codes added around fields are left intact
+func (mj *MatchJob) safe(text string) string {
+	if !mj.SafeOutput {
+		return text
+	}
+	return SafeText(text)
+}
+
+// highlight colours each match of re within text with MatchColor
+func (mj *MatchJob) highlight(re *regexp.Regexp, text string) string {
+	if mj.MatchColor == "" {
+		return text
+	}
+	return re.ReplaceAllStringFunc(text, func(match string) string {
+		return Colorize(mj.MatchColor, match)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// CommandReader pipes an object through an external command, such as a
+// decompressor for a format which is not built in, and reads its output
+type CommandReader struct {
+	command  string
+	cmd      *exec.Cmd
+	stdout   io.Reader
+	stderr   bytes.Buffer
+	eof      bool
+	finished bool
+	err      error
+}
+
+// StartCommandReader runs a shell command with input as its stdin
+func StartCommandReader(ctx context.Context, command string, input io.Reader) (*CommandReader, error) {
+	cr := &CommandReader{command: command}
+	cr.cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	cr.cmd.Stdin = input
+	cr.cmd.Stderr = &cr.stderr
+	stdout, err := cr.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cr.stdout = stdout
+	if err := cr.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+	return cr, nil
+}
+
+// Read implements io.Reader, reading the command's stdout
+func (cr *CommandReader) Read(data []byte) (int, error) {
+	n, err := cr.stdout.Read(data)
+	if err == io.EOF {
+		cr.eof = true
+	}
+	return n, err
+}
+
+// Finish waits for the command to exit, reporting a nonzero exit status
+// along with anything it wrote to stderr. A command whose output was not
+// read to the end is killed, and its exit status ignored. Finish may be
+// called more than once
+func (cr *CommandReader) Finish() error {
+	if cr.finished {
+		return cr.err
+	}
+	cr.finished = true
+	if !cr.eof {
+		cr.cmd.Process.Kill()
+		cr.cmd.Wait()
+		return nil
+	}
+	if err := cr.cmd.Wait(); err != nil {
+		cr.err = fmt.Errorf("%s: %v: %s", cr.command, err, strings.TrimSpace(cr.stderr.String()))
+	}
+	return cr.err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// MatchCounts is a concurrency-safe tally of matches per object key,
+// populated by search workers and read once searching is complete
+type MatchCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewMatchCounts initialises an empty MatchCounts
+func NewMatchCounts() *MatchCounts {
+	return &MatchCounts{counts: map[string]int{}}
+}
+
+// Add records n matches against a key
+func (mc *MatchCounts) Add(key string, n int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.counts[key] += n
+}
+
+// Snapshot returns a copy of the current counts
+func (mc *MatchCounts) Snapshot() map[string]int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	snapshot := make(map[string]int, len(mc.counts))
+	for key, n := range mc.counts {
+		snapshot[key] = n
+	}
+	return snapshot
+}
+
+// Keys returns the counted keys in sorted order
+func (mc *MatchCounts) Keys() []string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	keys := make([]string, 0, len(mc.counts))
+	for key := range mc.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
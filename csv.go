@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// MatchCSV parses an object as CSV delimited by FieldDelimiter and applies
+// the content regex to each field, so that quoted fields containing the
+// delimiter or newlines are matched whole. Each matching field is printed
+// prefixed with its 1-based row and column. With a MatchField, only that
+// column is matched
+func (mj *MatchJob) MatchCSV(obj ObjectInfo, reader io.Reader) (int, error) {
+	records := csv.NewReader(reader)
+	records.Comma, _ = utf8.DecodeRuneInString(mj.FieldDelimiter)
+	records.FieldsPerRecord = -1
+	records.LazyQuotes = true
+	records.ReuseRecord = true
+	matches := 0
+	for row := 1; ; row++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+		for i, field := range record {
+			column := i + 1
+			if mj.MatchField > 0 && column != mj.MatchField {
+				continue
+			}
+			if !mj.MatchContentString(field) {
+				continue
+			}
+			field = mj.safe(field)
+			if mj.Replacement != "" {
+				field = mj.ContentMatch.ReplaceAllString(field, mj.Replacement)
+			} else {
+				field = mj.highlight(mj.ContentMatch, field)
+			}
+			text := strconv.Itoa(row) + mj.FieldSeparator + strconv.Itoa(column) + mj.FieldSeparator + field
+			if !mj.PrintMatch(obj, text) {
+				return matches, nil
+			}
+			matches++
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// LineKeys is a concurrency-safe record of the keys each matching line was
+// found in, used to report lines duplicated across objects. A nil LineKeys
+// records nothing
+type LineKeys struct {
+	mu    sync.Mutex
+	lines map[string]map[string]bool
+}
+
+// NewLineKeys initialises an empty LineKeys
+func NewLineKeys() *LineKeys {
+	return &LineKeys{lines: map[string]map[string]bool{}}
+}
+
+// Add records that a line was found in the object with the given key
+func (lk *LineKeys) Add(line, key string) {
+	if lk == nil {
+		return
+	}
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	keys, ok := lk.lines[line]
+	if !ok {
+		keys = map[string]bool{}
+		lk.lines[line] = keys
+	}
+	keys[key] = true
+}
+
+// Duplicate is a line found in more than one object
+type Duplicate struct {
+	Line string
+	Keys []string
+}
+
+// Duplicates returns the lines found in more than one object, in sorted
+// order, each with its sorted keys
+func (lk *LineKeys) Duplicates() []Duplicate {
+	lk.mu.Lock()
+	defer lk.mu.Unlock()
+	var duplicates []Duplicate
+	for line, set := range lk.lines {
+		if len(set) < 2 {
+			continue
+		}
+		keys := make([]string, 0, len(set))
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		duplicates = append(duplicates, Duplicate{Line: line, Keys: keys})
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Line < duplicates[j].Line })
+	return duplicates
+}
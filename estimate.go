@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// CostEstimate accumulates the expected cost of a search from list metadata
+type CostEstimate struct {
+	Requests int64
+	Bytes    int64
+}
+
+// Add accounts for a single object that would be downloaded
+func (ce *CostEstimate) Add(obj ObjectInfo) {
+	ce.Requests++
+	ce.Bytes += obj.Size
+}
+
+// Dollars prices the estimate given per-GB transfer and per-1000 GET
+// request rates
+func (ce *CostEstimate) Dollars(perGB, per1000 float64) float64 {
+	return float64(ce.Bytes)/1073741824*perGB + float64(ce.Requests)/1000*per1000
+}
+
+// EstimateCost lists name-matching objects and reports what searching them
+// would cost, without downloading anything. Buckets which cannot be listed
+// are reported and left out of the estimate, and an error is returned
+func (mj *MatchJob) EstimateCost(ctx context.Context, perGB, per1000 float64) error {
+	var estimate CostEstimate
+	buckets := mj.Context.Buckets()
+	failed := 0
+	for _, bucket := range buckets {
+		job := mj.ForBucket(bucket)
+		listed := true
+		for obj := range job.ListObjects(ctx, job.ObjectSource()) {
+			if obj.Err != nil {
+				listed = mj.listingFailed(ctx, bucket, obj.Err) && listed
+				continue
+			}
+			if job.WantObject(obj) && !job.TooLarge(obj) {
+				estimate.Add(obj)
+			}
+		}
+		if !listed {
+			failed++
+		}
+	}
+	fmt.Printf("estimated %d GET requests and %d MB transfer, approximately $%.2f\n",
+		estimate.Requests, estimate.Bytes/1048576, estimate.Dollars(perGB, per1000))
+	return bucketsFailed(failed, len(buckets))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+// LineFilter is a compiled -filter-expr, a boolean expr-lang expression
+// evaluated against each line. The line is available as line, and the
+// fields of a line holding a JSON object as json, so that for example
+// len(line) > 100 && line contains "ERROR" or json.status >= 500 may be used
+type LineFilter struct {
+	program *vm.Program
+	useJSON bool
+}
+
+// filterEnv is the environment a LineFilter is evaluated in
+type filterEnv struct {
+	Line string                 `expr:"line"`
+	JSON map[string]interface{} `expr:"json"`
+}
+
+// CompileLineFilter compiles a filter expression, which must be boolean
+func CompileLineFilter(source string) (*LineFilter, error) {
+	program, err := expr.Compile(source, expr.Env(filterEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+	usesJSON := ast.Find(program.Node(), func(node ast.Node) bool {
+		ident, ok := node.(*ast.IdentifierNode)
+		return ok && ident.Value == "json"
+	}) != nil
+	return &LineFilter{program: program, useJSON: usesJSON}, nil
+}
+
+// Match reports whether a line satisfies the filter. Lines which cannot be
+// evaluated, such as those where a JSON field has an unexpected type, do
+// not match
+func (lf *LineFilter) Match(line string) bool {
+	env := filterEnv{Line: line}
+	if lf.useJSON {
+		// lines which are not JSON objects leave json nil
+		json.Unmarshal([]byte(line), &env.JSON)
+	}
+	result, err := expr.Run(lf.program, env)
+	if err != nil {
+		return false
+	}
+	matched, _ := result.(bool)
+	return matched
+}
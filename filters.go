@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is a flag.Value holding a number of bytes, written either plainly
+// or with a K, KB, M, MB, G or GB suffix in multiples of 1024
+type ByteSize int64
+
+// byteSizeUnits maps ByteSize suffixes to multipliers, longest first
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// String implements flag.Value
+func (bs *ByteSize) String() string {
+	return strconv.FormatInt(int64(*bs), 10)
+}
+
+// Set implements flag.Value
+func (bs *ByteSize) Set(value string) error {
+	number, multiplier := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*bs = ByteSize(n * multiplier)
+	return nil
+}
+
+// ParseTimeBound parses a -since or -until value, which is either an
+// RFC 3339 time or a duration such as 24h counting back from now. An empty
+// value is the zero time, meaning no bound
+func ParseTimeBound(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if age, err := time.ParseDuration(value); err == nil {
+		return now.Add(-age), nil
+	}
+	bound, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or a duration such as 24h", value)
+	}
+	return bound, nil
+}
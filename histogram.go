@@ -0,0 +1,128 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTimestampRegex finds ISO 8601 style timestamps such as
+// 2024-01-02T15:04:05Z or 2024-01-02 15:04:05.123
+const defaultTimestampRegex = `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?`
+
+// timestampLayouts are tried in turn when parsing timestamps. Those without
+// a zone are taken to be UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC1123Z,
+	time.RFC1123,
+	"02/Jan/2006:15:04:05 -0700",
+	time.Stamp,
+}
+
+// histogramBarWidth is the length of the bar drawn for the fullest bucket
+const histogramBarWidth = 50
+
+// maxHistogramGap is the most empty buckets filled in between those with
+// matches, so that a stray timestamp cannot make the histogram enormous
+const maxHistogramGap = 10000
+
+// Histogram is a concurrency-safe count of matching lines per interval,
+// keyed by a timestamp found in each line. A nil Histogram counts nothing
+type Histogram struct {
+	Regex    *regexp.Regexp
+	Interval time.Duration
+	mu       sync.Mutex
+	counts   map[time.Time]int
+}
+
+// NewHistogram creates a histogram of the timestamps found by regex, which
+// are taken from its first capture group if it has one
+func NewHistogram(regex *regexp.Regexp, interval time.Duration) *Histogram {
+	return &Histogram{Regex: regex, Interval: interval, counts: map[time.Time]int{}}
+}
+
+// Add counts a line in the bucket for its timestamp. Lines without a
+// parseable timestamp are ignored
+func (h *Histogram) Add(line string) {
+	if h == nil {
+		return
+	}
+	found := h.Regex.FindStringSubmatch(line)
+	if found == nil {
+		return
+	}
+	text := found[0]
+	if len(found) > 1 {
+		text = found[1]
+	}
+	stamp, ok := ParseTimestamp(text)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[stamp.UTC().Truncate(h.Interval)]++
+}
+
+// ParseTimestamp parses a timestamp in any of timestampLayouts, accepting a
+// space in place of the T between date and time
+func ParseTimestamp(text string) (time.Time, bool) {
+	text = strings.TrimSpace(text)
+	if len(text) > 10 && text[10] == ' ' && text[4] == '-' {
+		text = text[:10] + "T" + text[11:]
+	}
+	for _, layout := range timestampLayouts {
+		if stamp, err := time.Parse(layout, text); err == nil {
+			return stamp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// HistogramBucket is the number of matches in the interval beginning at Start
+type HistogramBucket struct {
+	Start time.Time
+	Count int
+}
+
+// Buckets returns the buckets in time order, including empty buckets
+// between the first and last unless there would be more than
+// maxHistogramGap of them
+func (h *Histogram) Buckets() []HistogramBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	starts := make([]time.Time, 0, len(h.counts))
+	for start := range h.counts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	var buckets []HistogramBucket
+	for i, start := range starts {
+		if i > 0 {
+			gap := start.Sub(starts[i-1]) / h.Interval
+			for empty := starts[i-1].Add(h.Interval); gap <= maxHistogramGap && empty.Before(start); empty = empty.Add(h.Interval) {
+				buckets = append(buckets, HistogramBucket{Start: empty})
+			}
+		}
+		buckets = append(buckets, HistogramBucket{Start: start, Count: h.counts[start]})
+	}
+	return buckets
+}
+
+// Bar returns a bar of # characters for count, scaled so that max fills
+// histogramBarWidth
+func Bar(count, max int) string {
+	if max == 0 {
+		return ""
+	}
+	length := count * histogramBarWidth / max
+	if length == 0 && count > 0 {
+		length = 1
+	}
+	return strings.Repeat("#", length)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// InventoryManifest is the manifest.json written alongside each S3 Inventory
+// report. Only the fields needed to locate and decode the data files are kept
+type InventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// ParseS3URL splits an s3://bucket/key URL into its bucket and key
+func ParseS3URL(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not an s3://bucket/key URL", location)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// InventorySource enumerates a bucket from the CSV data files of an S3
+// Inventory report instead of listing it, which is cheaper for very large
+// buckets and avoids list throttling. Objects are fetched from S3 as usual
+type InventorySource struct {
+	*S3Source
+	Manifest string
+}
+
+// ReadManifest fetches and decodes the inventory manifest
+func (is *InventorySource) ReadManifest(ctx context.Context) (*InventoryManifest, error) {
+	bucket, key, err := ParseS3URL(is.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := is.Context.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	manifest := &InventoryManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", is.Manifest, err)
+	}
+	return manifest, nil
+}
+
+// List implements ObjectSource
+func (is *InventorySource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		if err := is.list(ctx, prefix, objects); err != nil {
+			sendObject(ctx, objects, ObjectInfo{Err: err})
+		}
+	}()
+	return objects
+}
+
+// list delivers the objects under prefix from every inventory data file
+func (is *InventorySource) list(ctx context.Context, prefix string, objects chan<- ObjectInfo) error {
+	manifest, err := is.ReadManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(manifest.FileFormat, "CSV") {
+		return fmt.Errorf("unsupported inventory format %s, only CSV is supported", manifest.FileFormat)
+	}
+	columns := map[string]int{}
+	for i, name := range strings.Split(manifest.FileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"Bucket", "Key"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("inventory schema has no %s column", required)
+		}
+	}
+	bucket := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::")
+	for _, file := range manifest.Files {
+		more, err := is.readFile(ctx, bucket, file.Key, prefix, columns, objects)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile lists the objects named in one gzipped CSV inventory file. It
+// returns false if ctx was cancelled
+func (is *InventorySource) readFile(ctx context.Context, bucket, key, prefix string, columns map[string]int, objects chan<- ObjectInfo) (bool, error) {
+	resp, err := is.Context.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	decompressed, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", key, err)
+	}
+	records := csv.NewReader(decompressed)
+	records.FieldsPerRecord = -1
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", key, err)
+		}
+		if columns["Bucket"] >= len(record) || record[columns["Bucket"]] != *is.Context.Bucket {
+			continue
+		}
+		obj, ok := inventoryObject(record, columns)
+		if !ok || !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		if !sendObject(ctx, objects, obj) {
+			return false, nil
+		}
+	}
+}
+
+// inventoryObject converts an inventory CSV record to an ObjectInfo. Keys in
+// inventory reports are URL-encoded
+func inventoryObject(record []string, columns map[string]int) (ObjectInfo, bool) {
+	field := func(name string) (string, bool) {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return "", false
+		}
+		return record[i], true
+	}
+	encoded, ok := field("Key")
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	key, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return ObjectInfo{}, false
+	}
+	obj := ObjectInfo{Key: key}
+	if value, ok := field("Size"); ok {
+		obj.Size, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := field("LastModifiedDate"); ok {
+		obj.LastModified, _ = time.Parse(time.RFC3339, value)
+	}
+	if value, ok := field("ETag"); ok {
+		obj.ETag = value
+	}
+	if value, ok := field("StorageClass"); ok {
+		obj.StorageClass = value
+	}
+	return obj, true
+}
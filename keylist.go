@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ReadKeysCSV reads object keys from a 1-based column of a CSV file with a
+// header row, such as an Athena query result, returning the keys to search
+// in each of buckets. Plain keys are searched in every bucket, but keys may
+// also be given as s3://bucket/key URLs, which are searched only in the
+// bucket named, and must name one of buckets. Repeated keys are returned
+// once
+func ReadKeysCSV(filename string, column int, buckets []string) (map[string][]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := csv.NewReader(file)
+	records.FieldsPerRecord = -1
+	if _, err := records.Read(); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	keys := map[string][]string{}
+	seen := map[string]bool{}
+	add := func(bucket, key string) {
+		if !seen[bucket+"/"+key] {
+			seen[bucket+"/"+key] = true
+			keys[bucket] = append(keys[bucket], key)
+		}
+	}
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if column > len(record) || record[column-1] == "" {
+			continue
+		}
+		key := record[column-1]
+		if !strings.HasPrefix(key, "s3://") {
+			for _, bucket := range buckets {
+				add(bucket, key)
+			}
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, "s3://"), "/", 2)
+		if len(parts) < 2 || parts[1] == "" {
+			continue
+		}
+		if !containsString(buckets, parts[0]) {
+			return nil, fmt.Errorf("%s: %s is not in a bucket being searched", filename, key)
+		}
+		add(parts[0], parts[1])
+	}
+}
+
+// containsString reports whether list includes s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectStatter is implemented by sources which can describe a single object
+// without listing
+type ObjectStatter interface {
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// Stat implements ObjectStatter using a HEAD request
+func (ss *S3Source) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	head, err := ss.Context.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(*ss.Context.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+		ETag:         strings.Trim(aws.StringValue(head.ETag), `"`),
+		StorageClass: aws.StringValue(head.StorageClass),
+	}, nil
+}
+
+// Stat implements ObjectStatter
+func (ds *DirSource) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(filepath.Join(ds.Root, filepath.FromSlash(key)))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+// KeyListSource enumerates a fixed list of keys instead of listing Source,
+// from which the objects are described and fetched. Keys which cannot be
+// described, such as those which no longer exist, are passed to Skipped
+type KeyListSource struct {
+	Source  ObjectSource
+	Keys    []string
+	Skipped func(key string, err error)
+}
+
+// List implements ObjectSource, delivering the listed keys which begin with
+// prefix
+func (ks *KeyListSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		statter, ok := ks.Source.(ObjectStatter)
+		if !ok {
+			sendObject(ctx, objects, ObjectInfo{Err: fmt.Errorf("this backend cannot search a list of keys")})
+			return
+		}
+		for _, key := range ks.Keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			obj, err := statter.Stat(ctx, key)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				ks.Skipped(key, err)
+				continue
+			}
+			if !sendObject(ctx, objects, obj) {
+				return
+			}
+		}
+	}()
+	return objects
+}
+
+// Get implements ObjectSource
+func (ks *KeyListSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return ks.Source.Get(ctx, key)
+}
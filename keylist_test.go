@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestReadKeysCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		csv     string
+		buckets []string
+		want    map[string][]string
+		err     string
+	}{
+		{
+			"plain keys",
+			"key,size\na.log,1\nb.log,2\na.log,1\n,3\n",
+			[]string{"one"},
+			map[string][]string{"one": {"a.log", "b.log"}},
+			"",
+		},
+		{
+			"plain keys in every bucket",
+			"key\na.log\n",
+			[]string{"one", "two"},
+			map[string][]string{"one": {"a.log"}, "two": {"a.log"}},
+			"",
+		},
+		{
+			"urls routed to their bucket",
+			"key\ns3://two/a.log\ns3://one/b.log\ns3://two/a.log\nc.log\ns3://one/\n",
+			[]string{"one", "two"},
+			map[string][]string{"one": {"b.log", "c.log"}, "two": {"a.log", "c.log"}},
+			"",
+		},
+		{
+			"url outside -bucket",
+			"key\ns3://one/a.log\ns3://three/b.log\n",
+			[]string{"one", "two"},
+			nil,
+			"s3://three/b.log is not in a bucket being searched",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, "keys.csv")
+			if err := ioutil.WriteFile(filename, []byte(tt.csv), 0644); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := ReadKeysCSV(filename, 1, tt.buckets)
+			if tt.err != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("keys %q, want %q", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyListBucket(t *testing.T) {
+	mj, _ := newTestJob(nil, "")
+	mj.Context.Bucket = aws.String("one,two")
+	mj.KeyList = map[string][]string{"one": {"a.log"}, "two": {"b.log", "c.log"}}
+	for bucket, want := range mj.KeyList {
+		source, ok := mj.ForBucket(bucket).ObjectSource().(*KeyListSource)
+		if !ok || !reflect.DeepEqual(source.Keys, want) {
+			t.Errorf("%s: searching %v, want %q", bucket, source, want)
+		}
+	}
+}
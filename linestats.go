@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// LineLengths counts lines by length within a single object or chunk, to be
+// merged into LineStats once it is scanned. A nil LineLengths counts nothing
+type LineLengths map[int]int64
+
+// Add counts a line of the given length
+func (ll LineLengths) Add(length int) {
+	if ll != nil {
+		ll[length]++
+	}
+}
+
+// LineStats is a concurrency-safe count of lines by length across every
+// object scanned, whether or not they match. Lines are at most
+// bufio.MaxScanTokenSize long, so the counts stay small enough to give
+// exact percentiles. A nil LineStats counts nothing
+type LineStats struct {
+	mu     sync.Mutex
+	counts map[int]int64
+}
+
+// NewLineStats initialises an empty LineStats
+func NewLineStats() *LineStats {
+	return &LineStats{counts: map[int]int64{}}
+}
+
+// Tally returns an empty LineLengths to count an object's lines in, or nil
+// if ls is nil
+func (ls *LineStats) Tally() LineLengths {
+	if ls == nil {
+		return nil
+	}
+	return LineLengths{}
+}
+
+// Merge adds the counts from a tally
+func (ls *LineStats) Merge(ll LineLengths) {
+	if ls == nil {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for length, count := range ll {
+		ls.counts[length] += count
+	}
+}
+
+// LineLengthReport summarises the lengths of the lines counted, in bytes
+type LineLengthReport struct {
+	Lines int64   `json:"lines"`
+	Min   int     `json:"min"`
+	Max   int     `json:"max"`
+	Mean  float64 `json:"mean"`
+	P50   int     `json:"p50"`
+	P90   int     `json:"p90"`
+	P99   int     `json:"p99"`
+}
+
+// String formats the report for text output
+func (r LineLengthReport) String() string {
+	return fmt.Sprintf("lines=%d min=%d max=%d mean=%.1f p50=%d p90=%d p99=%d",
+		r.Lines, r.Min, r.Max, r.Mean, r.P50, r.P90, r.P99)
+}
+
+// Report returns the statistics of the lines counted so far. Percentiles
+// are nearest-rank, so each is the length of a line actually seen
+func (ls *LineStats) Report() LineLengthReport {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	lengths := make([]int, 0, len(ls.counts))
+	var report LineLengthReport
+	var total int64
+	for length, count := range ls.counts {
+		lengths = append(lengths, length)
+		report.Lines += count
+		total += int64(length) * count
+	}
+	if report.Lines == 0 {
+		return report
+	}
+	sort.Ints(lengths)
+	report.Min, report.Max = lengths[0], lengths[len(lengths)-1]
+	report.Mean = float64(total) / float64(report.Lines)
+	ranks := []struct {
+		percent int64
+		value   *int
+	}{{50, &report.P50}, {90, &report.P90}, {99, &report.P99}}
+	var seen int64
+	next := 0
+	for _, length := range lengths {
+		seen += ls.counts[length]
+		for next < len(ranks) && seen*100 >= ranks[next].percent*report.Lines {
+			*ranks[next].value = length
+			next++
+		}
+	}
+	return report
+}
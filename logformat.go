@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LogParser splits a log line into named fields, reporting false for lines
+// which are not in the expected format
+type LogParser func(line string) (map[string]string, bool)
+
+// LogParsers maps -format names to their parsers
+var LogParsers = map[string]LogParser{
+	"cef":    ParseCEF,
+	"syslog": ParseSyslog,
+}
+
+// FieldMatch is a regex applied to a single named field of a parsed line
+type FieldMatch struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// FieldMatches is a flag.Value collecting repeated name=regex arguments
+type FieldMatches []FieldMatch
+
+// String implements flag.Value
+func (fm *FieldMatches) String() string {
+	parts := make([]string, len(*fm))
+	for i, match := range *fm {
+		parts[i] = match.Name + "=" + match.Pattern.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, parsing a single name=regex argument
+func (fm *FieldMatches) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return fmt.Errorf("field match %q is not of the form name=regex", value)
+	}
+	pattern, err := regexp.Compile(value[i+1:])
+	if err != nil {
+		return err
+	}
+	*fm = append(*fm, FieldMatch{Name: value[:i], Pattern: pattern})
+	return nil
+}
+
+// Match reports whether every field match is satisfied by the parsed fields.
+// A missing field never matches
+func (fm FieldMatches) Match(fields map[string]string) bool {
+	for _, match := range fm {
+		value, ok := fields[match.Name]
+		if !ok || !match.Pattern.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// cefHeaderFields names the pipe-delimited fields preceding a CEF extension
+var cefHeaderFields = []string{
+	"version",
+	"deviceVendor",
+	"deviceProduct",
+	"deviceVersion",
+	"signatureId",
+	"name",
+	"severity",
+}
+
+// cefUnescaper reverses the backslash escaping used in CEF headers and
+// extension values
+var cefUnescaper = strings.NewReplacer(`\\`, `\`, `\|`, `|`, `\=`, `=`, `\n`, "\n", `\r`, "\r")
+
+// ParseCEF parses an ArcSight Common Event Format line, which may be wrapped
+// in a syslog header. Header fields are named as in cefHeaderFields and
+// extension fields by their own keys, e.g. src or suser
+func ParseCEF(line string) (map[string]string, bool) {
+	start := strings.Index(line, "CEF:")
+	if start < 0 {
+		return nil, false
+	}
+	rest := line[start+len("CEF:"):]
+	fields := make(map[string]string)
+	for _, name := range cefHeaderFields {
+		end := cefHeaderEnd(rest)
+		if end < 0 {
+			return nil, false
+		}
+		fields[name] = cefUnescaper.Replace(rest[:end])
+		rest = rest[end+1:]
+	}
+	parseCEFExtension(rest, fields)
+	return fields, true
+}
+
+// cefHeaderEnd returns the index of the first unescaped pipe, or -1
+func cefHeaderEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '|':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseCEFExtension adds the key=value pairs of a CEF extension to fields.
+// Values may contain spaces, so each value runs up to the key of the next
+// unescaped equals sign
+func parseCEFExtension(ext string, fields map[string]string) {
+	type pair struct{ keyStart, eq int }
+	var pairs []pair
+	last := -1
+	for i := 0; i < len(ext); i++ {
+		switch ext[i] {
+		case '\\':
+			i++
+		case '=':
+			start := strings.LastIndexByte(ext[:i], ' ') + 1
+			if start > last && start < i {
+				pairs = append(pairs, pair{start, i})
+				last = i
+			}
+		}
+	}
+	for n, p := range pairs {
+		end := len(ext)
+		if n+1 < len(pairs) {
+			end = pairs[n+1].keyStart
+		}
+		fields[ext[p.keyStart:p.eq]] = cefUnescaper.Replace(strings.TrimSpace(ext[p.eq+1 : end]))
+	}
+}
+
+// syslog5424 matches RFC 5424 syslog lines
+var syslog5424 = regexp.MustCompile(`^<(\d{1,3})>(\d{1,2}) (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[(?:[^\]\\]|\\.)*\])+) ?(.*)$`)
+
+// syslog3164 matches BSD syslog lines, with or without the leading priority
+// as commonly found in files written by syslog daemons
+var syslog3164 = regexp.MustCompile(`^(?:<(\d{1,3})>)?([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (\S+) ([^:\[\s]+)(?:\[([^\]]*)\])?: ?(.*)$`)
+
+// ParseSyslog parses an RFC 5424 or BSD (RFC 3164) syslog line into the
+// fields priority, facility, severity, timestamp, hostname, appName, procId
+// and message, plus version, msgId and structuredData for RFC 5424 lines
+func ParseSyslog(line string) (map[string]string, bool) {
+	if m := syslog5424.FindStringSubmatch(line); m != nil {
+		fields := map[string]string{
+			"version":        m[2],
+			"timestamp":      m[3],
+			"hostname":       m[4],
+			"appName":        m[5],
+			"procId":         m[6],
+			"msgId":          m[7],
+			"structuredData": m[8],
+			"message":        m[9],
+		}
+		addSyslogPriority(m[1], fields)
+		return fields, true
+	}
+	if m := syslog3164.FindStringSubmatch(line); m != nil {
+		fields := map[string]string{
+			"timestamp": m[2],
+			"hostname":  m[3],
+			"appName":   m[4],
+			"procId":    m[5],
+			"message":   m[6],
+		}
+		addSyslogPriority(m[1], fields)
+		return fields, true
+	}
+	return nil, false
+}
+
+// addSyslogPriority records a syslog PRI value and the facility and
+// severity it encodes
+func addSyslogPriority(pri string, fields map[string]string) {
+	n, err := strconv.Atoi(pri)
+	if err != nil {
+		return
+	}
+	fields["priority"] = pri
+	fields["facility"] = strconv.Itoa(n / 8)
+	fields["severity"] = strconv.Itoa(n % 8)
+}
+
+// IndentJSON reformats a line holding a JSON object or array over several
+// indented lines, returning any other line unchanged
+func IndentJSON(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return line
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(trimmed), "", "  "); err != nil {
+		return line
+	}
+	return indented.String()
+}
+
+// JSONFields extracts named fields from a line holding a JSON object,
+// reporting false for any other line. Names may be dotted paths into nested
+// objects. Strings are returned as-is and other values as JSON, while missing
+// fields are empty
+func JSONFields(line string, names []string) ([]string, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return nil, false
+	}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, false
+	}
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = jsonField(object, name)
+	}
+	return values, true
+}
+
+// jsonField looks up a dotted path in a decoded JSON object
+func jsonField(object map[string]interface{}, path string) string {
+	var value interface{} = object
+	for _, name := range strings.Split(path, ".") {
+		parent, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = parent[name]; !ok {
+			return ""
+		}
+	}
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
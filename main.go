@@ -2,184 +2,2548 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"filippo.io/age"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"golang.org/x/oauth2"
 )
 
 // AppContext encapsulates global app config
 type AppContext struct {
-	Region *string
-	Bucket *string
-	Prefix *string
-	S3     *s3.S3
+	Region               *string
+	Bucket               *string
+	Prefixes             PrefixList
+	PrefixFile           *string
+	DateRange            *string
+	PartitionFormat      *string
+	ClientSideEncryption *bool
+	Profile              *string
+	CredentialsFile      *string
+	CredentialsProfile   *string
+	ProxyURL             *string
+	CABundle             *string
+	UserAgent            *string
+	UseFIPS              *bool
+	UseDualStack         *bool
+	ForcePathStyle       *bool
+	Anonymous            *bool
+	SourceURL            *string
+	Backend              *string
+	Source               ObjectSource
+	HTTP                 *http.Client
+	S3                   s3iface.S3API
+	Decrypter            ObjectGetter
 }
 
-// NewAppContext initialises a global app config object
+// ObjectGetter fetches objects from S3. It is implemented by both the S3
+// client and the decryption client of the S3 encryption client
+type ObjectGetter interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+// NewAppContext initialises a global app config object. Connect must be
+// called once flags have been parsed
 func NewAppContext() *AppContext {
 	context := &AppContext{
 		Region: flag.String("region", "us-west-2", "AWS region to operate in"),
-		Bucket: flag.String("bucket", "", "Name of S3 bucket to operate in"),
-		Prefix: flag.String("prefix", "", "Bucket object base prefix"),
+		Bucket: flag.String("bucket", "", "Name of S3 bucket to operate in, or a comma-separated list of buckets"),
+		ClientSideEncryption: flag.Bool("client-side-encryption", false,
+			"Decrypt objects written by the S3 encryption client (KMS envelope)"),
+		Profile: flag.String("sso-profile", "",
+			"Named profile from the shared AWS config, such as an AWS SSO profile"),
+		CredentialsFile: flag.String("credentials-file", "",
+			"AWS shared credentials file to take credentials from instead of the default chain"),
+		CredentialsProfile: flag.String("credentials-profile", "",
+			"Profile to use from -credentials-file (default \"default\")"),
+		ProxyURL: flag.String("proxy-url", "", "HTTP(S) proxy URL used for AWS requests"),
+		CABundle: flag.String("ca-bundle", "", "PEM file of CA certificates trusted for AWS requests"),
+		UserAgent: flag.String("user-agent", "",
+			"Text added to the User-Agent of AWS requests, identifying the search in CloudTrail and access logs"),
+		UseFIPS:      flag.Bool("use-fips", false, "Use FIPS 140-2 validated S3 endpoints"),
+		UseDualStack: flag.Bool("use-dualstack", false, "Use dual-stack (IPv4 and IPv6) S3 endpoints"),
+		ForcePathStyle: flag.Bool("force-path-style", false,
+			"Address buckets in the URL path rather than the host name, as some proxies and S3-compatible stores require"),
+		Anonymous: flag.Bool("anonymous", false, "Make unsigned requests, without credentials, to search public S3 or GCS buckets"),
+		SourceURL: flag.String("source", "",
+			"Search a local directory given as file://DIR instead of S3"),
+		Backend: flag.String("backend", backendS3,
+			"Object store holding -bucket: s3, gcs (Google Cloud Storage) or azure (Blob Storage container)"),
+		PrefixFile: flag.String("prefix-file", "", "File of prefixes to search in addition to -prefix, one per line"),
+		DateRange: flag.String("date-range", "",
+			"Search the partitions of -partition-format for each day from START to END inclusive, as START:END such as 2024-01-01:2024-01-07"),
+		PartitionFormat: flag.String("partition-format", "",
+			"Prefix of a date partition, with {yyyy}, {MM}, {dd} and {HH} placeholders, such as logs/{yyyy}/{MM}/{dd}/"),
 	}
-	sess, _ := session.NewSession(&aws.Config{Region: aws.String(*context.Region)})
-	context.S3 = s3.New(sess)
+	flag.Var(&context.Prefixes, "prefix", "Bucket object base prefix; repeat to search several prefixes concurrently")
 	return context
 }
 
+// PrefixList is a flag.Value collecting repeated -prefix arguments
+type PrefixList []string
+
+// String implements flag.Value
+func (pl *PrefixList) String() string {
+	return strings.Join(*pl, ",")
+}
+
+// Set implements flag.Value
+func (pl *PrefixList) Set(value string) error {
+	*pl = append(*pl, value)
+	return nil
+}
+
+// ReadFile adds the prefixes listed one per line in a file, ignoring blank
+// lines
+func (pl *PrefixList) ReadFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if prefix := strings.TrimSpace(scanner.Text()); prefix != "" {
+			*pl = append(*pl, prefix)
+		}
+	}
+	return scanner.Err()
+}
+
+// List returns the prefixes to list, which is a single empty prefix
+// covering the whole bucket if none were given
+func (pl PrefixList) List() []string {
+	if len(pl) == 0 {
+		return []string{""}
+	}
+	return pl
+}
+
+// Group returns the prefix a key falls under, extended by the first depth
+// path segments of the key after it. Keys with no more than depth segments
+// after the prefix are returned whole
+func (pl PrefixList) Group(key string, depth int) string {
+	prefix := ""
+	for _, candidate := range pl.List() {
+		if strings.HasPrefix(key, candidate) && len(candidate) > len(prefix) {
+			prefix = candidate
+		}
+	}
+	segments := strings.SplitAfter(key[len(prefix):], "/")
+	if len(segments) <= depth {
+		return key
+	}
+	return prefix + strings.Join(segments[:depth], "")
+}
+
+// Contains reports whether a key falls under any of the prefixes
+func (pl PrefixList) Contains(key string) bool {
+	for _, prefix := range pl.List() {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// PatternList is a flag.Value collecting repeated regular expression
+// arguments
+type PatternList []string
+
+// String implements flag.Value
+func (pl *PatternList) String() string {
+	return strings.Join(*pl, ",")
+}
+
+// Set implements flag.Value
+func (pl *PatternList) Set(value string) error {
+	if _, err := regexp.Compile(value); err != nil {
+		return err
+	}
+	*pl = append(*pl, value)
+	return nil
+}
+
+// List returns a copy of the patterns, which is a single empty pattern
+// matching everything if none were given
+func (pl PatternList) List() []string {
+	if len(pl) == 0 {
+		return []string{""}
+	}
+	return append([]string(nil), pl...)
+}
+
+// Connect creates the AWS session and S3 clients. Shared config is always
+// enabled so that profiles from ~/.aws/config, including AWS SSO and
+// assume-role profiles, resolve as they do for the AWS CLI, unless
+// -credentials-file names a credentials file to use instead, or -anonymous
+// asks for requests to be left unsigned. Any -user-agent is appended to the
+// SDK's own User-Agent. With a -source URL, the source is opened instead and
+// AWS is not used at all. The gcs and azure backends need only an HTTP
+// client, which authenticates GCS requests with GCSTokenSource unless
+// -anonymous is given
+func (ctx *AppContext) Connect() error {
+	if *ctx.SourceURL != "" {
+		source, err := OpenSource(*ctx.SourceURL)
+		if err != nil {
+			return err
+		}
+		ctx.Source = source
+		return nil
+	}
+	client, err := ctx.HTTPClient()
+	if err != nil {
+		return err
+	}
+	pacer := &Pacer{}
+	if *ctx.Backend != backendS3 {
+		base := client.Transport
+		client.Transport = &pacingTransport{Transport: base, Pacer: pacer}
+		if *ctx.Backend == backendGCS && !*ctx.Anonymous {
+			tokenCtx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base})
+			source, err := GCSTokenSource(tokenCtx)
+			if err != nil {
+				return err
+			}
+			client.Transport = &oauth2.Transport{Source: source, Base: client.Transport}
+		}
+		ctx.HTTP = client
+		return nil
+	}
+	ctx.HTTP = client
+	config := aws.Config{
+		Region:     aws.String(*ctx.Region),
+		HTTPClient: client,
+	}
+	if *ctx.ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if *ctx.UseFIPS {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if *ctx.UseDualStack {
+		config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	switch {
+	case *ctx.Anonymous:
+		config.Credentials = credentials.AnonymousCredentials
+	case *ctx.CredentialsFile != "":
+		config.Credentials = credentials.NewSharedCredentials(*ctx.CredentialsFile, *ctx.CredentialsProfile)
+	}
+	sess, err := session.NewSessionWithOptions(ctx.SessionOptions(config))
+	if err != nil {
+		return err
+	}
+	pacer.AddHandlers(&sess.Handlers)
+	if *ctx.UserAgent != "" {
+		sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(*ctx.UserAgent))
+	}
+	ctx.S3 = s3.New(sess)
+	if *ctx.ClientSideEncryption {
+		ctx.Decrypter, err = NewDecrypter(sess)
+	}
+	return err
+}
+
+// SessionOptions returns the options the AWS session is created with, using
+// config as the base configuration. Shared config is always enabled, so that
+// -sso-profile and AWS_PROFILE can name any profile from ~/.aws/config
+func (ctx *AppContext) SessionOptions(config aws.Config) session.Options {
+	return session.Options{
+		Config:            config,
+		Profile:           *ctx.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+}
+
+// NewDecrypter creates a client decrypting objects written by either version
+// of the S3 encryption client: KMS-wrapped keys with or without an
+// encryption context, and AES-GCM or legacy AES-CBC content. Any CMK named
+// in an object's metadata is used
+func NewDecrypter(sess *session.Session) (*s3crypto.DecryptionClientV2, error) {
+	registry := s3crypto.NewCryptoRegistry()
+	kmsClient := kms.New(sess)
+	for _, register := range []func() error{
+		func() error { return s3crypto.RegisterKMSContextWrapWithAnyCMK(registry, kmsClient) },
+		func() error { return s3crypto.RegisterKMSWrapWithAnyCMK(registry, kmsClient) },
+		func() error { return s3crypto.RegisterAESGCMContentCipher(registry) },
+		func() error { return s3crypto.RegisterAESCBCContentCipher(registry, s3crypto.AESCBCPadder) },
+	} {
+		if err := register(); err != nil {
+			return nil, err
+		}
+	}
+	return s3crypto.NewDecryptionClientV2(sess, registry)
+}
+
+// HTTPClient builds the HTTP client used for AWS requests, honouring any
+// proxy and CA bundle overrides. Transparent gzip decoding is disabled so
+// that object bodies arrive as stored, to be decoded according to their
+// Content-Encoding. The transport is left as a plain *http.Transport, which
+// the SDK needs in order to apply AWS_CA_BUNDLE, and is paced by Connect
+func (ctx *AppContext) HTTPClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	if *ctx.ProxyURL != "" {
+		proxy, err := url.Parse(*ctx.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %v", *ctx.ProxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if *ctx.CABundle != "" {
+		bundle, err := ioutil.ReadFile(*ctx.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", *ctx.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Buckets returns the names of all buckets to operate in
+func (ctx *AppContext) Buckets() []string {
+	return strings.Split(*ctx.Bucket, ",")
+}
+
+// Validate reports missing or malformed connection flags
+func (ctx *AppContext) Validate() error {
+	if *ctx.SourceURL != "" {
+		return nil
+	}
+	switch *ctx.Backend {
+	case backendS3, backendGCS, backendAzure:
+	default:
+		return fmt.Errorf("unknown backend %q", *ctx.Backend)
+	}
+	if *ctx.CredentialsProfile != "" && *ctx.CredentialsFile == "" {
+		return errors.New("-credentials-profile requires -credentials-file")
+	}
+	if (*ctx.CredentialsFile != "" || *ctx.UseFIPS || *ctx.UseDualStack || *ctx.ForcePathStyle) && *ctx.Backend != backendS3 {
+		return errors.New("-credentials-file, -use-fips, -use-dualstack and -force-path-style require the s3 backend")
+	}
+	if *ctx.Anonymous && *ctx.Backend == backendAzure {
+		return errors.New("-anonymous requires the s3 or gcs backend; azure requests are anonymous without AZURE_STORAGE_SAS_TOKEN")
+	}
+	if *ctx.Anonymous && (*ctx.CredentialsFile != "" || *ctx.ClientSideEncryption) {
+		return errors.New("-anonymous cannot be used with -credentials-file, or with -client-side-encryption, which needs credentials for KMS")
+	}
+	if *ctx.Backend == backendAzure && os.Getenv("AZURE_STORAGE_ACCOUNT") == "" {
+		return errors.New("AZURE_STORAGE_ACCOUNT must be set for the azure backend")
+	}
+	for _, bucket := range ctx.Buckets() {
+		if bucket == "" {
+			return errors.New("-bucket is required, and bucket names in a list must not be empty")
+		}
+	}
+	return nil
+}
+
+// WithBucket returns a copy of the context operating on a single bucket
+func (ctx *AppContext) WithBucket(bucket string) *AppContext {
+	single := *ctx
+	single.Bucket = aws.String(bucket)
+	return &single
+}
+
+// Check confirms that credentials, region and bucket access are usable by
+// making the cheapest possible requests against each bucket
+func (ctx *AppContext) Check() error {
+	if ctx.Source != nil {
+		return nil
+	}
+	if !ctx.UsesS3() {
+		for _, bucket := range ctx.Buckets() {
+			if err := ctx.WithBucket(bucket).checkSource(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, bucket := range ctx.Buckets() {
+		if err := ctx.WithBucket(bucket).checkBucket(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsesS3 reports whether objects are read from S3, so that S3-specific
+// features are available
+func (ctx *AppContext) UsesS3() bool {
+	return *ctx.SourceURL == "" && *ctx.Backend == backendS3
+}
+
+// BucketSource returns the ObjectSource for the context's bucket on a
+// non-S3 backend, or nil for S3
+func (ctx *AppContext) BucketSource() ObjectSource {
+	switch *ctx.Backend {
+	case backendGCS:
+		return NewGCSSource(ctx.HTTP, *ctx.Bucket)
+	case backendAzure:
+		return NewAzureSource(ctx.HTTP, *ctx.Bucket)
+	}
+	return nil
+}
+
+// checkSource confirms that the first page of a non-S3 bucket can be listed
+func (ctx *AppContext) checkSource() error {
+	listCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for obj := range ctx.BucketSource().List(listCtx, ctx.Prefixes.List()[0]) {
+		if obj.Err != nil {
+			return fmt.Errorf("list objects in %s: %v", *ctx.Bucket, obj.Err)
+		}
+		break
+	}
+	return nil
+}
+
+func (ctx *AppContext) checkBucket() error {
+	_, err := ctx.S3.HeadBucket(&s3.HeadBucketInput{Bucket: ctx.Bucket})
+	if err != nil {
+		return fmt.Errorf("head bucket %s: %v", *ctx.Bucket, err)
+	}
+	for _, prefix := range ctx.Prefixes.List() {
+		_, err = ctx.S3.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:  ctx.Bucket,
+			MaxKeys: aws.Int64(1),
+			Prefix:  aws.String(prefix),
+		})
+		if err != nil {
+			return fmt.Errorf("list objects in %s/%s: %v", *ctx.Bucket, prefix, err)
+		}
+	}
+	return nil
+}
+
 // MatchJob encapsulates data for a search operation
 type MatchJob struct {
-	Context      *AppContext
-	NameMatch    *regexp.Regexp
-	ContentMatch *regexp.Regexp
-	ShowKeys     bool
+	Context              *AppContext
+	NameMatches          []*regexp.Regexp
+	NameMatchAll         bool
+	ContentMatch         *regexp.Regexp
+	ShowKeys             bool
+	MultilineMatch       *regexp.Regexp
+	MultilineMaxBytes    int64
+	RecordSeparator      []byte
+	SelectExpression     string
+	NoDecompress         bool
+	Text                 bool
+	MaxDecompressedBytes int64
+	Output               *Output
+	Replacement          string
+	IncludeEmpty         bool
+	MaxLines             int64
+	WholeObject          bool
+	Checkpoint           *Checkpoint
+	ShowTimestamps       bool
+	Count                bool
+	Counts               *MatchCounts
+	Owner                string
+	ACLPublic            bool
+	ParallelBuckets      int
+	ListErrors           bool
+	SampleRate           float64
+	SampleSeed           int64
+	TrimSpace            bool
+	ShowTrimmed          bool
+	Concurrency          int
+	Parser               LogParser
+	Fields               FieldMatches
+	SkipLargerThan       int64
+	Progress             *Progress
+	Action               *Action
+	InventoryManifest    string
+	LineStart            int64
+	LineEnd              int64
+	FieldSeparator       string
+	Source               ObjectSource
+	DecompressCommand    string
+	Peek                 int
+	MemberMatch          *regexp.Regexp
+	Buffers              *BufferBudget
+	SpoolDir             string
+	Checksum             *ChecksumFilter
+	PrintFields          []string
+	MatchField           int
+	FieldDelimiter       string
+	CSV                  bool
+	GroupDepth           int
+	Groups               *MatchCounts
+	ShowMeta             bool
+	ExcludeKeys          map[string]bool
+	OutputFormat         string
+	KeyColor             string
+	MatchColor           string
+	MinSize              int64
+	Since                time.Time
+	Until                time.Time
+	SummaryInterval      time.Duration
+	NullKeys             bool
+	Range                string
+	AgeIdentities        []age.Identity
+	Duplicates           *LineKeys
+	MaxTotalBytes        int64
+	PrettyJSON           bool
+	KeyList              map[string][]string
+	SafeOutput           bool
+	MatchWorkers         int
+	Histogram            *Histogram
+	QuietErrors          bool
+	Filter               *LineFilter
+	KeyDepth             int
+	GroupOutput          bool
+	MultipartOnly        bool
+	SinglePartOnly       bool
+	LineStats            *LineStats
+	MatchTimeout         time.Duration
+	IncludeSpans         bool
+	OrderedOutput        bool
+	printed              *int64
+	scanned              *int64
+	downloaded           *int64
+	warnings             *int64
+	qualifyKeys          bool
+	cancel               context.CancelFunc
+	literal              string
+	isLiteral            bool
 }
 
 // NewMatchJob initialises a MatchJob object and compiles regexes
 func NewMatchJob(ctx *AppContext, nmatch, cmatch string) *MatchJob {
 	mj := &MatchJob{
-		Context:      ctx,
-		NameMatch:    regexp.MustCompile(nmatch),
-		ContentMatch: regexp.MustCompile(cmatch),
-		ShowKeys:     false,
+		Context:        ctx,
+		NameMatches:    []*regexp.Regexp{regexp.MustCompile(nmatch)},
+		ContentMatch:   regexp.MustCompile(cmatch),
+		ShowKeys:       false,
+		Output:         NewOutput(os.Stdout, 4096),
+		Counts:         NewMatchCounts(),
+		Groups:         NewMatchCounts(),
+		Progress:       NewProgress(os.Stderr, false),
+		Source:         ctx.Source,
+		MemberMatch:    regexp.MustCompile(""),
+		SampleRate:     1,
+		FieldSeparator: ":",
+		FieldDelimiter: ",",
+		OutputFormat:   outputText,
+		Concurrency:    1,
+		printed:        new(int64),
+		scanned:        new(int64),
+		downloaded:     new(int64),
+		warnings:       new(int64),
 	}
+	mj.literal, mj.isLiteral = literalPattern(cmatch)
 	return mj
 }
 
+// literalPattern reports whether a regex is nothing but a case-sensitive
+// literal, returning the literal. Anchors, word boundaries and flags all
+// rule out a substring search. LiteralPrefix is no help here, as it ignores
+// anchors
+func literalPattern(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(re.Rune), true
+}
+
+// MatchContentString reports whether text matches the content regex. Regexes
+// which are plain literals, such as those given with -F, are matched with a
+// substring search, which is considerably faster and finds the same lines
+func (mj *MatchJob) MatchContentString(text string) bool {
+	if mj.isLiteral {
+		return strings.Contains(text, mj.literal)
+	}
+	return mj.ContentMatch.MatchString(text)
+}
+
+// AddNameMatch adds a further key regex. Keys must match any one of the key
+// regexes, or every one if NameMatchAll is set
+func (mj *MatchJob) AddNameMatch(nmatch string) {
+	mj.NameMatches = append(mj.NameMatches, regexp.MustCompile(nmatch))
+}
+
+// MatchName reports whether a key satisfies the key regexes
+func (mj *MatchJob) MatchName(key string) bool {
+	for _, nameMatch := range mj.NameMatches {
+		if nameMatch.MatchString(key) != mj.NameMatchAll {
+			return !mj.NameMatchAll
+		}
+	}
+	return mj.NameMatchAll
+}
+
 // SetShowKeys alters the value of the ShowKeys option
 func (mj *MatchJob) SetShowKeys(sk *bool) {
 	mj.ShowKeys = *sk
 }
 
-// ListObjectsWithCallback lists all objects in a bucket and invokes a
-// callback for each page
-func (mj *MatchJob) ListObjectsWithCallback(fn func(*s3.ListObjectsV2Output, bool) bool) error {
-	input := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(*mj.Context.Bucket),
-		MaxKeys: aws.Int64(100),
-		Prefix:  mj.Context.Prefix,
+// SetMultiline enables matching the content regex against whole objects with
+// dotall semantics, so that matches may span lines. Objects decompressing to
+// more than maxBytes are skipped, as they must be buffered in memory
+func (mj *MatchJob) SetMultiline(maxBytes int64) {
+	mj.MultilineMatch = regexp.MustCompile("(?s)" + mj.ContentMatch.String())
+	mj.MultilineMaxBytes = maxBytes
+}
+
+// SetWholeObject enables matching the content regex once against each whole
+// object, printing only the keys of matching objects
+func (mj *MatchJob) SetWholeObject(maxBytes int64) {
+	mj.SetMultiline(maxBytes)
+	mj.WholeObject = true
+}
+
+// SetRecordSeparator configures content matching to operate on records
+// delimited by sep rather than on lines. The separator is taken literally
+func (mj *MatchJob) SetRecordSeparator(sep string) error {
+	if sep == "" {
+		return fmt.Errorf("record separator must not be empty")
 	}
-	return mj.Context.S3.ListObjectsV2Pages(input, fn)
+	mj.RecordSeparator = []byte(sep)
+	return nil
 }
 
-// JustListNameMatches does exactly that; no content matching is performed
-func (mj *MatchJob) JustListNameMatches() {
-	err := mj.ListObjectsWithCallback(func(page *s3.ListObjectsV2Output, last bool) bool {
-		for _, obj := range page.Contents {
-			if mj.NameMatch.MatchString(*obj.Key) {
-				fmt.Fprintf(os.Stderr, "object key matched: %v\n", *obj.Key)
-			}
-		}
-		return last
-	})
+// UnescapeSeparator interprets Go escape sequences such as \n and \x00 in a
+// separator given on the command line
+func UnescapeSeparator(sep string) (string, error) {
+	unquoted, err := strconv.Unquote(`"` + strings.Replace(sep, `"`, `\"`, -1) + `"`)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("invalid escapes in separator %q: %v", sep, err)
 	}
+	return unquoted, nil
 }
 
-// GetObject wraps S3.GetObject with local context
-func (mj *MatchJob) GetObject(key string) (*s3.GetObjectOutput, error) {
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(*mj.Context.Bucket),
-		Key:    aws.String(key),
+// ScanRecords returns a bufio.SplitFunc which splits input into records
+// delimited by sep. The separator is not included in the returned tokens
+func ScanRecords(sep []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, sep); i >= 0 {
+			return i + len(sep), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
 	}
-	return mj.Context.S3.GetObject(input)
 }
 
-// TransparentExpandingReader creates a Reader that transparently decompresses based
-// on filename
-func TransparentExpandingReader(key string, source io.ReadCloser) io.Reader {
-	ext := path.Ext(key)
-	var reader io.Reader
-	var err error
-	switch {
-	case ext == ".gz":
-		reader, err = gzip.NewReader(source)
-		if err != nil {
-			panic(err)
-		}
-	case ext == ".bz2":
-		reader = bzip2.NewReader(source)
-	default:
-		reader = bufio.NewReader(source)
-	}
-	return reader
-}
-
-// ListContentMatches ...
-func (mj *MatchJob) ListContentMatches() {
-	totalMatches := 0
-	objchan := make(chan *s3.GetObjectOutput, 5000)
-	errchan := make(chan string, 5000)
-	err := mj.ListObjectsWithCallback(func(page *s3.ListObjectsV2Output, last bool) bool {
-		var wg sync.WaitGroup
-		for _, obj := range page.Contents {
-			if mj.NameMatch.MatchString(*obj.Key) {
-				wg.Add(1)
-				go func(key string) {
-					defer wg.Done()
-					obj, err := mj.GetObject(key)
-					if err != nil {
-						errchan <- key
-					} else {
-						reader := TransparentExpandingReader(key, obj.Body)
-						scanner := bufio.NewScanner(reader)
-						matches := 0
-						for scanner.Scan() {
-							text := scanner.Text()
-							if mj.ContentMatch.MatchString(text) {
-								if mj.ShowKeys {
-									fmt.Printf("%s:%s\n", key, text)
-								} else {
-									fmt.Println(text)
-								}
-								matches++
-							}
-						}
-						fmt.Fprintf(os.Stderr, "%s: %d matches\n", key, matches)
-						totalMatches += matches
-						objchan <- obj
-					}
-				}(*obj.Key)
+// SetFormat selects the parser used for field matching by name. Field
+// matches given without a format are applied to CEF lines
+func (mj *MatchJob) SetFormat(name string) error {
+	if name == "" {
+		name = "cef"
+	}
+	parser, ok := LogParsers[name]
+	if !ok {
+		return fmt.Errorf("unknown log format %q", name)
+	}
+	mj.Parser = parser
+	return nil
+}
+
+// ObjectSource returns where the job lists and fetches objects from. Unless
+// Source is set, this is the job's bucket, read from its S3 Inventory report
+// if one is configured. If KeyList is set, only the keys it lists for the
+// job's bucket are enumerated
+func (mj *MatchJob) ObjectSource() ObjectSource {
+	source := mj.listingSource()
+	if mj.KeyList != nil {
+		return &KeyListSource{Source: source, Keys: mj.KeyList[*mj.Context.Bucket], Skipped: func(key string, err error) {
+			mj.Warnf(mj.DisplayKey(key), "skipped, %v", err)
+		}}
+	}
+	return source
+}
+
+// listingSource returns the source objects are listed from when no KeyList
+// is set
+func (mj *MatchJob) listingSource() ObjectSource {
+	if mj.Source != nil {
+		return mj.Source
+	}
+	if source := mj.Context.BucketSource(); source != nil {
+		return source
+	}
+	source := &S3Source{Context: mj.Context, FetchOwner: mj.Owner != "", Range: mj.Range}
+	if mj.InventoryManifest != "" {
+		return &InventorySource{S3Source: source, Manifest: mj.InventoryManifest}
+	}
+	return source
+}
+
+// ListObjects lists the objects under each configured prefix of a source,
+// listing up to ParallelBuckets prefixes concurrently
+func (mj *MatchJob) ListObjects(ctx context.Context, source ObjectSource) <-chan ObjectInfo {
+	prefixes := mj.Context.Prefixes.List()
+	if len(prefixes) == 1 {
+		return source.List(ctx, prefixes[0])
+	}
+	merged := make(chan ObjectInfo)
+	slots := make(chan struct{}, mj.parallelListings())
+	var wg sync.WaitGroup
+	for _, prefix := range prefixes {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			for obj := range source.List(ctx, prefix) {
+				if !sendObject(ctx, merged, obj) {
+					return
+				}
+			}
+		}(prefix)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	return merged
+}
+
+// WantObject reports whether a listed object should be searched. Zero-byte
+// objects can never match and are skipped unless IncludeEmpty is set.
+// Directory markers, keys ending in a slash which consoles create to stand
+// in for folders, are always skipped, as are keys in ExcludeKeys. The filters
+// combine, so an object must pass every one that is set, including MinSize,
+// the Since and Until bounds on its LastModified time and KeyDepth, the
+// exact number of slash-separated components in its key. MultipartOnly and
+// SinglePartOnly select objects by how they were uploaded, as shown by the
+// -N part count suffix of a multipart upload's ETag
+func (mj *MatchJob) WantObject(obj ObjectInfo) bool {
+	if strings.HasSuffix(obj.Key, "/") {
+		return false
+	}
+	if mj.KeyDepth > 0 && strings.Count(obj.Key, "/")+1 != mj.KeyDepth {
+		return false
+	}
+	if obj.Size < mj.MinSize {
+		return false
+	}
+	if !mj.Since.IsZero() && obj.LastModified.Before(mj.Since) {
+		return false
+	}
+	if !mj.Until.IsZero() && obj.LastModified.After(mj.Until) {
+		return false
+	}
+	if !mj.MatchName(obj.Key) {
+		return false
+	}
+	if obj.Size == 0 && !mj.IncludeEmpty {
+		return false
+	}
+	if mj.Owner != "" && !OwnedBy(obj, mj.Owner) {
+		return false
+	}
+	if mj.SampleRate < 1 && !mj.Sampled(obj.Key) {
+		return false
+	}
+	if mj.Checksum != nil && mj.Checksum.Listed() && !mj.Checksum.Matches(obj.ETag) {
+		return false
+	}
+	if multipart := strings.Contains(obj.ETag, "-"); (mj.MultipartOnly && !multipart) || (mj.SinglePartOnly && multipart) {
+		return false
+	}
+	if mj.ExcludeKeys[obj.Key] || mj.ExcludeKeys[mj.DisplayKey(obj.Key)] {
+		return false
+	}
+	return true
+}
+
+// Warnf reports an object which was skipped on a line of its own. With
+// QuietErrors set the report is only counted, for the total given once
+// searching is complete
+func (mj *MatchJob) Warnf(key, format string, args ...interface{}) {
+	atomic.AddInt64(mj.warnings, 1)
+	if !mj.QuietErrors {
+		mj.Progress.Logf("%s: %s\n", mj.safe(key), fmt.Sprintf(format, args...))
+	}
+}
+
+// TooLarge reports whether an object exceeds SkipLargerThan. Unlike the
+// filters in WantObject, callers are expected to report such objects
+func (mj *MatchJob) TooLarge(obj ObjectInfo) bool {
+	return mj.SkipLargerThan > 0 && obj.Size > mj.SkipLargerThan
+}
+
+// JustListNameMatches does exactly that; no content matching is performed.
+// Keys of the objects which would be searched are written to the output. A
+// bucket which cannot be listed is reported and the rest are still listed,
+// with an error returned once they are done
+func (mj *MatchJob) JustListNameMatches(ctx context.Context) error {
+	ctx, mj.cancel = context.WithCancel(ctx)
+	defer mj.cancel()
+	buckets := mj.Context.Buckets()
+	mj.qualifyKeys = len(buckets) > 1
+	failed := 0
+	for _, bucket := range buckets {
+		job := mj.ForBucket(bucket)
+		listed := true
+		for obj := range job.ListObjects(ctx, job.ObjectSource()) {
+			if obj.Err != nil {
+				listed = mj.listingFailed(ctx, bucket, obj.Err) && listed
+				continue
+			}
+			if job.WantObject(obj) && !job.emitKey(obj) {
+				break
 			}
 		}
-		go func() {
-			wg.Wait()
-		}()
+		if !listed {
+			failed++
+		}
+	}
+	return bucketsFailed(failed, len(buckets))
+}
+
+// listingFailed reports an error which ended a listing of a bucket,
+// returning false unless the listing ended because ctx was cancelled
+func (mj *MatchJob) listingFailed(ctx context.Context, bucket string, err error) bool {
+	if ctx.Err() != nil {
 		return true
-	})
+	}
+	mj.Progress.Logf("listing %s: %v\n", bucket, err)
+	return false
+}
+
+// bucketsFailed returns an error if any of the buckets could not be listed
+func bucketsFailed(failed, buckets int) error {
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d buckets could not be listed", failed, buckets)
+}
+
+// GetObject fetches an object's content from the job's object source
+func (mj *MatchJob) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return mj.ObjectSource().Get(ctx, key)
+}
+
+// ContentEncoded is implemented by object bodies which were served with HTTP
+// Content-Encoding and Content-Type headers
+type ContentEncoded interface {
+	ContentEncoding() string
+	ContentType() string
+}
+
+// Compression formats recognised by TransparentExpandingReader
+const (
+	compressionNone  = ""
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+)
+
+// TransparentExpandingReader creates a Reader that transparently decompresses
+// an object. Both the gzip and bzip2 readers continue across concatenated
+// streams, so appended multi-stream objects are read in full. The format is
+// taken from the first of these which identifies one: a gzip
+// Content-Encoding, so that objects stored compressed without a .gz
+// extension are still decompressed; the key's extension; a gzip or bzip2
+// Content-Type; and finally the magic bytes at the start of the content
+func TransparentExpandingReader(key string, source io.ReadCloser) (io.Reader, error) {
+	format := compressionNone
+	if encoded, ok := source.(ContentEncoded); ok {
+		switch strings.ToLower(strings.TrimSpace(encoded.ContentEncoding())) {
+		case "gzip", "x-gzip":
+			format = compressionGzip
+		}
+	}
+	if format == compressionNone {
+		switch path.Ext(key) {
+		case ".gz", ".tgz":
+			format = compressionGzip
+		case ".bz2", ".tbz2":
+			format = compressionBzip2
+		}
+	}
+	if encoded, ok := source.(ContentEncoded); ok && format == compressionNone {
+		format = contentTypeCompression(encoded.ContentType())
+	}
+	buffered := bufio.NewReader(source)
+	if format == compressionNone {
+		format = magicCompression(buffered)
+	}
+	switch format {
+	case compressionGzip:
+		return gunzip(buffered)
+	case compressionBzip2:
+		return bzip2.NewReader(buffered), nil
+	default:
+		return buffered, nil
+	}
+}
+
+// contentTypeCompression returns the compression format named by a
+// Content-Type, ignoring any parameters
+func contentTypeCompression(contentType string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/x-gzip-compressed":
+		return compressionGzip
+	case "application/x-bzip2", "application/x-bzip":
+		return compressionBzip2
+	}
+	return compressionNone
+}
+
+// magicCompression returns the compression format identified by the magic
+// bytes at the start of a stream, without consuming them
+func magicCompression(reader *bufio.Reader) string {
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return compressionGzip
+	case len(magic) == 4 && bytes.HasPrefix(magic, []byte("BZh")) && magic[3] >= '1' && magic[3] <= '9':
+		return compressionBzip2
+	}
+	return compressionNone
+}
+
+// ErrTruncated is returned when a gzip stream ends part way through, as
+// happens with interrupted uploads
+var ErrTruncated = errors.New("gzip stream truncated")
+
+// gunzip decompresses a gzip stream, reporting an unexpected end of the
+// compressed data as ErrTruncated so that it can be told apart from other
+// read errors
+func gunzip(source io.Reader) (io.Reader, error) {
+	reader, err := gzip.NewReader(source)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	close(objchan)
-	close(errchan)
-	var totalLength int64
-	objs := 0
-	for obj := range objchan {
-		totalLength += *obj.ContentLength
-		objs++
+	return &truncationReader{Reader: reader}, nil
+}
+
+// truncationReader converts io.ErrUnexpectedEOF from Reader to ErrTruncated
+type truncationReader struct {
+	Reader io.Reader
+}
+
+func (r *truncationReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
 	}
-	fmt.Fprintf(os.Stderr, "searched %d MB logs in %d objects and found %d matches\n",
-		totalLength/1048576, objs, totalMatches)
+	return n, err
 }
 
-func main() {
-	context := NewAppContext()
-	showkeys := flag.Bool("show-keys", false, "Include S3 keys with matching lines, like traditional grep")
-	keymatch := flag.String("key-match", "", "String match on S3 object key")
-	contentmatch := flag.String("content-match", "", "String match on S3 object key")
-	flag.Parse()
-	mj := NewMatchJob(context, *keymatch, *contentmatch)
-	mj.SetShowKeys(showkeys)
-	mj.ListContentMatches()
+// ErrSizeLimit is returned by SizeLimitReader once its limit is exceeded
+var ErrSizeLimit = errors.New("decompressed size limit exceeded")
+
+// SizeLimitReader reads from Reader until more than Limit bytes have been
+// read in total, after which it fails with ErrSizeLimit. This bounds the
+// work done on objects whose decompressed size is unknown up front
+type SizeLimitReader struct {
+	Reader io.Reader
+	Limit  int64
+	read   int64
+}
+
+func (r *SizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.Limit {
+		return n, ErrSizeLimit
+	}
+	return n, err
+}
+
+// ErrMatchTimeout is returned by TimeLimitReader once its deadline passes,
+// and by matching once the deadline for searching an object passes
+var ErrMatchTimeout = errors.New("match timeout exceeded")
+
+// timedOut reports whether the MatchTimeout deadline for searching an object
+// has passed
+func (obj ObjectInfo) timedOut() bool {
+	return !obj.deadline.IsZero() && time.Now().After(obj.deadline)
+}
+
+// TimeLimitReader reads from Reader until Deadline, after which it fails
+// with ErrMatchTimeout. This bounds the time spent downloading an object,
+// while matching checks the same deadline line by line
+type TimeLimitReader struct {
+	Reader   io.Reader
+	Deadline time.Time
+}
+
+func (r *TimeLimitReader) Read(p []byte) (int, error) {
+	if time.Now().After(r.Deadline) {
+		return 0, ErrMatchTimeout
+	}
+	return r.Reader.Read(p)
+}
+
+// CountingReader adds the number of bytes read from Reader to Count, which
+// may be shared by concurrent readers
+type CountingReader struct {
+	Reader io.Reader
+	Count  *int64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.Count, int64(n))
+	return n, err
+}
+
+// ErrTotalBytes is returned by object reads once more than -max-total-bytes
+// have been downloaded across all objects
+var ErrTotalBytes = errors.New("total download limit reached")
+
+// downloadLimitReader adds the bytes downloaded for an object to the job's
+// shared total, failing once the total passes MaxTotalBytes. The read which
+// takes the total past the limit also cancels the search. The headers of a
+// ContentEncoded body are passed through for TransparentExpandingReader
+type downloadLimitReader struct {
+	io.ReadCloser
+	job *MatchJob
+}
+
+// ContentEncoding implements ContentEncoded
+func (r *downloadLimitReader) ContentEncoding() string {
+	if encoded, ok := r.ReadCloser.(ContentEncoded); ok {
+		return encoded.ContentEncoding()
+	}
+	return ""
+}
+
+// ContentType implements ContentEncoded
+func (r *downloadLimitReader) ContentType() string {
+	if encoded, ok := r.ReadCloser.(ContentEncoded); ok {
+		return encoded.ContentType()
+	}
+	return ""
+}
+
+func (r *downloadLimitReader) Read(p []byte) (int, error) {
+	mj := r.job
+	if atomic.LoadInt64(mj.downloaded) > mj.MaxTotalBytes {
+		return 0, ErrTotalBytes
+	}
+	n, err := r.ReadCloser.Read(p)
+	total := atomic.AddInt64(mj.downloaded, int64(n))
+	if total > mj.MaxTotalBytes && total-int64(n) <= mj.MaxTotalBytes {
+		mj.Progress.Logf("downloaded more than %d bytes, stopping search (-max-total-bytes)\n", mj.MaxTotalBytes)
+		mj.cancel()
+	}
+	return n, err
+}
+
+// binaryCheckBytes is how much of an object is inspected by IsBinary
+const binaryCheckBytes = 8192
+
+// IsBinary reports whether a stream looks like binary data, using the same
+// NUL byte heuristic as grep. The returned reader replays the inspected bytes
+func IsBinary(reader io.Reader) (bool, io.Reader) {
+	buffered := bufio.NewReaderSize(reader, binaryCheckBytes)
+	head, _ := buffered.Peek(binaryCheckBytes)
+	return bytes.IndexByte(head, 0) >= 0, buffered
+}
+
+// emit writes a line of output. It returns false once MaxLines lines have
+// been written, at which point the search is cancelled
+func (mj *MatchJob) emit(line string) bool {
+	return mj.emitTerminated(line, "\n")
+}
+
+// emitTerminated writes output ending with terminator rather than a newline,
+// counting it as a line towards MaxLines
+func (mj *MatchJob) emitTerminated(line, terminator string) bool {
+	if mj.MaxLines > 0 {
+		printed := atomic.AddInt64(mj.printed, 1)
+		if printed > mj.MaxLines {
+			return false
+		}
+		if printed == mj.MaxLines {
+			defer mj.cancel()
+		}
+	}
+	mj.Output.Printf("%s%s", line, terminator)
+	return true
+}
+
+// emitKey writes the key of a matching object to the output, terminated by
+// a NUL byte rather than a newline if NullKeys is set
+func (mj *MatchJob) emitKey(obj ObjectInfo) bool {
+	if mj.OutputFormat == outputNDJSON {
+		return mj.emit(ObjectRecord(*mj.Context.Bucket, obj).JSON())
+	}
+	if mj.NullKeys {
+		return mj.emitTerminated(mj.MatchedKey(obj), "\x00")
+	}
+	return mj.emit(mj.MatchedKey(obj))
+}
+
+// PrintMatch writes a single content match to the output, prefixed with the
+// object key, its metadata and its last-modified time if requested. It
+// returns false once the output limit is reached. Nothing is printed in
+// count and list-errors modes. JSON records hold the byte offsets of each
+// match within the text if IncludeSpans is set, which is only meaningful
+// when the text is the matching line as found, untransformed
+func (mj *MatchJob) PrintMatch(obj ObjectInfo, text string) bool {
+	if mj.Count || mj.ListErrors {
+		return true
+	}
+	if mj.OutputFormat == outputNDJSON {
+		record := ObjectRecord(*mj.Context.Bucket, obj)
+		record.Match = text
+		if mj.IncludeSpans {
+			re := mj.ContentMatch
+			if mj.MultilineMatch != nil {
+				re = mj.MultilineMatch
+			}
+			record.Spans = re.FindAllStringIndex(text, -1)
+		}
+		return mj.emit(record.JSON())
+	}
+	if mj.ShowKeys || mj.ShowMeta {
+		text = mj.MatchedKey(obj) + mj.FieldSeparator + text
+	}
+	if mj.ShowTimestamps {
+		text = obj.LastModified.UTC().Format(time.RFC3339) + " " + text
+	}
+	return mj.emit(text)
+}
+
+// MatchLines applies the content regex to each line (or custom-delimited
+// record) of an object, returning the number of matching lines. Only lines
+// numbered from LineStart to LineEnd are considered, if set. The first Peek
+// lines of an object with a match are printed after its matches. Objects
+// larger than a chunk are matched by MatchWorkers goroutines at once if set.
+// The length of every line read is counted in LineStats, matching or not
+func (mj *MatchJob) MatchLines(obj ObjectInfo, reader io.Reader) (int, error) {
+	if mj.MatchWorkers > 1 && mj.RecordSeparator == nil && obj.Size > parallelChunkSize {
+		return mj.matchLinesParallel(obj, reader)
+	}
+	scanner := bufio.NewScanner(reader)
+	if mj.RecordSeparator != nil {
+		scanner.Split(ScanRecords(mj.RecordSeparator))
+	}
+	lengths := mj.LineStats.Tally()
+	defer mj.LineStats.Merge(lengths)
+	matches := 0
+	var line int64
+	var head []string
+	var err error
+	for scanner.Scan() {
+		if obj.timedOut() {
+			err = ErrMatchTimeout
+			break
+		}
+		line++
+		if len(head) < mj.Peek {
+			head = append(head, scanner.Text())
+		}
+		if mj.LineEnd > 0 && line > mj.LineEnd {
+			break
+		}
+		lengths.Add(len(scanner.Bytes()))
+		if line < mj.LineStart {
+			continue
+		}
+		text, ok := mj.matchLine(obj, scanner.Text())
+		if !ok {
+			continue
+		}
+		if !mj.PrintMatch(obj, text) {
+			break
+		}
+		matches++
+	}
+	if matches > 0 {
+		mj.PrintPeek(obj, head)
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	return matches, err
+}
+
+// matchLine applies the content regex to a single line, returning the text
+// to print if it matches. Leading and trailing whitespace is ignored when
+// matching if TrimSpace is set. With a Parser, lines which fail to parse or
+// to satisfy Fields do not match. With a MatchField, the regex is applied
+// only to that 1-based field of the line split on FieldDelimiter, and lines
+// with too few fields do not match, and with a Filter, neither do lines it
+// rejects. Matching JSON lines are prefixed with the values of PrintFields
+func (mj *MatchJob) matchLine(obj ObjectInfo, text string) (string, bool) {
+	subject := text
+	if mj.TrimSpace {
+		subject = strings.TrimSpace(text)
+		if mj.ShowTrimmed {
+			text = subject
+		}
+	}
+	if mj.Parser != nil {
+		fields, ok := mj.Parser(subject)
+		if !ok || !mj.Fields.Match(fields) {
+			return "", false
+		}
+	}
+	target := subject
+	if mj.MatchField > 0 {
+		fields := strings.Split(subject, mj.FieldDelimiter)
+		if len(fields) < mj.MatchField {
+			return "", false
+		}
+		target = fields[mj.MatchField-1]
+	}
+	if !mj.MatchContentString(target) {
+		return "", false
+	}
+	if mj.Filter != nil && !mj.Filter.Match(subject) {
+		return "", false
+	}
+	mj.Duplicates.Add(subject, mj.DisplayKey(obj.Key))
+	mj.Histogram.Add(subject)
+	text = mj.safe(text)
+	if mj.PrettyJSON {
+		text = IndentJSON(text)
+	}
+	if mj.Replacement != "" {
+		text = mj.ContentMatch.ReplaceAllString(text, mj.Replacement)
+	} else if target == subject {
+		text = mj.highlight(mj.ContentMatch, text)
+	}
+	if len(mj.PrintFields) > 0 {
+		if values, ok := JSONFields(subject, mj.PrintFields); ok {
+			text = mj.safe(strings.Join(values, mj.FieldSeparator)) + mj.FieldSeparator + text
+		}
+	}
+	return text, true
+}
+
+// PrintPeek writes the first lines of an object which matched, each prefixed
+// with "peek" and the object key so they stand apart from matching lines
+func (mj *MatchJob) PrintPeek(obj ObjectInfo, head []string) {
+	if mj.Count || mj.ListErrors {
+		return
+	}
+	for _, text := range head {
+		line := "peek" + mj.FieldSeparator + Colorize(mj.KeyColor, mj.safe(mj.DisplayKey(obj.Key))) + mj.FieldSeparator + mj.safe(text)
+		if mj.OutputFormat == outputNDJSON {
+			record := ObjectRecord(*mj.Context.Bucket, obj)
+			record.Peek = text
+			line = record.JSON()
+		}
+		if !mj.emit(line) {
+			return
+		}
+	}
+}
+
+// errMultilineTooLarge is returned by MatchMultiline for objects larger than
+// the configured buffer size
+var errMultilineTooLarge = errors.New("too large for multiline matching")
+
+// MatchMultiline reads an entire object and applies the multiline content
+// regex to it, returning the number of matches. In whole-object mode only
+// the key of a matching object is printed, except in count and list-errors
+// modes
+func (mj *MatchJob) MatchMultiline(obj ObjectInfo, reader io.Reader) (int, error) {
+	data, release, err := mj.Buffers.ReadAll(io.LimitReader(reader, mj.MultilineMaxBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) > mj.MultilineMaxBytes {
+		release()
+		return 0, errMultilineTooLarge
+	}
+	limit := -1
+	if mj.WholeObject {
+		limit = 1
+	}
+	found, err := mj.findMultiline(obj, data, limit, release)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	if mj.WholeObject {
+		if len(found) == 0 {
+			return 0, nil
+		}
+		if !mj.Count && !mj.ListErrors {
+			mj.emitKey(obj)
+		}
+		return 1, nil
+	}
+	matches := 0
+	for _, location := range found {
+		match := data[location[0]:location[1]]
+		text := Colorize(mj.MatchColor, mj.safe(string(match)))
+		if mj.Replacement != "" {
+			text = mj.safe(string(mj.MultilineMatch.ReplaceAll(match, []byte(mj.Replacement))))
+		}
+		if !mj.PrintMatch(obj, text) {
+			break
+		}
+		matches++
+	}
+	if matches > 0 && mj.Peek > 0 {
+		head := strings.SplitN(string(data), "\n", mj.Peek+1)
+		if len(head) > mj.Peek {
+			head = head[:mj.Peek]
+		}
+		mj.PrintPeek(obj, head)
+	}
+	return matches, nil
+}
+
+// findMultiline returns the locations of up to n matches of the multiline
+// regex in data, or all of them if n is negative. A single regex match
+// cannot be interrupted, so if obj times out first, ErrMatchTimeout is
+// returned and the match finishes in the background, calling release once
+// done with data. Otherwise releasing data is left to the caller
+func (mj *MatchJob) findMultiline(obj ObjectInfo, data []byte, n int, release func()) ([][]int, error) {
+	if obj.deadline.IsZero() {
+		return mj.MultilineMatch.FindAllIndex(data, n), nil
+	}
+	if obj.timedOut() {
+		release()
+		return nil, ErrMatchTimeout
+	}
+	var mu sync.Mutex
+	finished, abandoned := false, false
+	found := make(chan [][]int, 1)
+	go func() {
+		locations := mj.MultilineMatch.FindAllIndex(data, n)
+		mu.Lock()
+		finished = true
+		if abandoned {
+			release()
+		}
+		mu.Unlock()
+		found <- locations
+	}()
+	timer := time.NewTimer(time.Until(obj.deadline))
+	defer timer.Stop()
+	select {
+	case locations := <-found:
+		return locations, nil
+	case <-timer.C:
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return <-found, nil
+		}
+		abandoned = true
+		return nil, ErrMatchTimeout
+	}
+}
+
+// SearchObject fetches a single object and matches its content, returning
+// the number of matches found. Objects in a format understood by S3 Select
+// are filtered server-side when a select expression is configured. With a
+// DecompressCommand, objects are piped through it instead of being
+// decompressed according to their extension. Tar and zip archives are
+// searched member by member. Matches found before the end of a truncated
+// gzip object, or before MatchTimeout, are printed and counted, but the
+// object is still reported as failed. Objects encrypted with age are
+// decrypted first when identities are configured
+func (mj *MatchJob) SearchObject(ctx context.Context, obj ObjectInfo) (int, error) {
+	key := obj.Key
+	if mj.MatchTimeout > 0 {
+		obj.deadline = time.Now().Add(mj.MatchTimeout)
+	}
+	if mj.SelectExpression != "" {
+		if input := SelectInputSerialization(key); input != nil {
+			records, err := mj.SelectObject(ctx, key, input)
+			if err != nil {
+				return 0, err
+			}
+			defer records.Close()
+			return mj.MatchLines(obj, records)
+		}
+	}
+	body, err := mj.GetObject(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	if mj.MaxTotalBytes > 0 {
+		body = &downloadLimitReader{ReadCloser: body, job: mj}
+	}
+	name, source, err := mj.DecryptAge(key, body)
+	if err != nil {
+		return 0, err
+	}
+	var reader io.Reader = source
+	var command *CommandReader
+	switch {
+	case mj.DecompressCommand != "":
+		command, err = StartCommandReader(ctx, mj.DecompressCommand, source)
+		if err != nil {
+			return 0, err
+		}
+		defer command.Finish()
+		reader = command
+	case !mj.NoDecompress:
+		reader, err = TransparentExpandingReader(name, source)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if mj.MaxDecompressedBytes > 0 {
+		reader = &SizeLimitReader{Reader: reader, Limit: mj.MaxDecompressedBytes}
+	}
+	if !obj.deadline.IsZero() {
+		reader = &TimeLimitReader{Reader: reader, Deadline: obj.deadline}
+	}
+	reader = &CountingReader{Reader: reader, Count: mj.scanned}
+	var matches int
+	if format := ArchiveFormat(name); format != "" && command == nil && !mj.NoDecompress {
+		matches, err = mj.SearchArchive(obj, format, reader)
+	} else {
+		matches, err = mj.MatchContent(obj, reader)
+	}
+	if command != nil {
+		if cerr := command.Finish(); err == nil {
+			err = cerr
+		}
+	}
+	if err == ErrSizeLimit || err == errMultilineTooLarge || err == ErrBufferBudget {
+		mj.Warnf(key, "skipped, %v", err)
+		return matches, nil
+	}
+	return matches, err
+}
+
+// MatchContent matches decompressed content, skipping binary content unless
+// Text is set, or NoDecompress is, as raw compressed bytes always look
+// binary. CSV content is matched field by field if CSV is set
+func (mj *MatchJob) MatchContent(obj ObjectInfo, reader io.Reader) (int, error) {
+	if !mj.Text && !mj.NoDecompress {
+		var binary bool
+		binary, reader = IsBinary(reader)
+		if binary {
+			mj.Warnf(obj.Key, "skipped, binary content")
+			return 0, nil
+		}
+	}
+	if mj.CSV {
+		return mj.MatchCSV(obj, reader)
+	}
+	if mj.MultilineMatch != nil {
+		return mj.MatchMultiline(obj, reader)
+	}
+	return mj.MatchLines(obj, reader)
+}
+
+// ObjectResult records the outcome of searching a single object. Skipped
+// objects were listed but excluded by a per-object check. With
+// OrderedOutput, the object's output is held along with its position in
+// the listing until it is its turn to be written
+type ObjectResult struct {
+	Object   ObjectInfo
+	Matches  int
+	Err      error
+	Skipped  bool
+	seq      int
+	position int64
+	header   string
+	held     []byte
+}
+
+// searchListed applies any per-object checks to a listed object and then
+// searches it
+func (mj *MatchJob) searchListed(ctx context.Context, obj ObjectInfo) ObjectResult {
+	if mj.ACLPublic {
+		public, err := mj.IsPublic(ctx, obj.Key)
+		if err != nil {
+			return ObjectResult{Object: obj, Err: err}
+		}
+		if !public {
+			return ObjectResult{Object: obj, Skipped: true}
+		}
+	}
+	if mj.Checksum != nil && !mj.Checksum.Listed() {
+		checksum, err := mj.ObjectChecksum(ctx, obj.Key, mj.Checksum.Algorithm)
+		if err != nil {
+			return ObjectResult{Object: obj, Err: err}
+		}
+		if !mj.Checksum.Matches(checksum) {
+			return ObjectResult{Object: obj, Skipped: true}
+		}
+	}
+	if mj.GroupOutput || mj.OrderedOutput {
+		return mj.searchHeld(ctx, obj)
+	}
+	matches, err := mj.SearchObject(ctx, obj)
+	return ObjectResult{Object: obj, Matches: matches, Err: err}
+}
+
+// searchHeld searches an object with its output held back. With
+// GroupOutput, the output is given a "=== key ===" header, so that the lines
+// of concurrently searched objects are not interleaved. The output is
+// written at once in one block, or with OrderedOutput is left in the result
+// to be written in listing order
+func (mj *MatchJob) searchHeld(ctx context.Context, obj ObjectInfo) ObjectResult {
+	var held bytes.Buffer
+	job := *mj
+	job.Output = NewOutput(&held, 4096)
+	job.Output.RecordPrefix = mj.Output.RecordPrefix
+	matches, err := job.SearchObject(ctx, obj)
+	job.Output.Flush()
+	result := ObjectResult{Object: obj, Matches: matches, Err: err}
+	if held.Len() == 0 {
+		return result
+	}
+	if mj.GroupOutput {
+		result.header = "=== " + mj.MatchedKey(obj) + " ==="
+	}
+	if mj.OrderedOutput {
+		result.held = held.Bytes()
+		return result
+	}
+	mj.Output.WriteGroup(result.header, held.Bytes())
+	return result
+}
+
+// objectQueueSize bounds how far listing may run ahead of searching
+const objectQueueSize = 1000
+
+// ListContentMatches searches all selected objects in the job's bucket,
+// returning a summary. Listing feeds a bounded queue consumed by a pool of
+// Concurrency workers, so that listing and downloading overlap. It returns
+// only once every worker has finished; after cancellation, queued objects
+// are dropped rather than searched. With OrderedOutput, objects are numbered
+// as they are listed and their output written in that order as soon as
+// those before them are done, rather than held until the end of the search.
+// A Checkpoint advances past a page only once all its objects are done.
+// A listing which fails part way returns its error with the summary of the
+// objects searched before the failure
+func (mj *MatchJob) ListContentMatches(ctx context.Context) (*Summary, error) {
+	source := mj.ObjectSource()
+	var tracker *CheckpointTracker
+	if s3source, ok := source.(*S3Source); ok && mj.Checkpoint != nil {
+		token, err := mj.Checkpoint.Load()
+		if err != nil {
+			return NewSummary(), fmt.Errorf("loading checkpoint: %v", err)
+		}
+		s3source.Token = token
+		tracker = NewCheckpointTracker(mj.Checkpoint)
+		s3source.PageDone = func(delivered int64, next *string) {
+			if err := tracker.PageListed(delivered, next); err != nil {
+				mj.Progress.Logf("saving checkpoint: %v\n", err)
+			}
+		}
+	}
+	finished := func(position int64) {
+		if tracker == nil {
+			return
+		}
+		if err := tracker.Finished(position); err != nil {
+			mj.Progress.Logf("saving checkpoint: %v\n", err)
+		}
+	}
+	concurrency := mj.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	objects := make(chan sequencedObject, objectQueueSize)
+	results := make(chan ObjectResult)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for item := range objects {
+				if ctx.Err() != nil {
+					continue
+				}
+				result := mj.searchListed(ctx, item.obj)
+				result.seq, result.position = item.seq, item.position
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objects)
+		defer mj.Progress.ListingDone()
+		var err error
+		defer func() { listErr <- err }()
+		seq := 0
+		var position int64
+		for obj := range mj.ListObjects(ctx, source) {
+			if obj.Err != nil {
+				err = obj.Err
+				continue
+			}
+			position++
+			if !mj.WantObject(obj) {
+				finished(position - 1)
+				continue
+			}
+			if mj.TooLarge(obj) {
+				mj.Warnf(mj.DisplayKey(obj.Key), "skipped, %d bytes exceeds -skip-larger-than", obj.Size)
+				finished(position - 1)
+				continue
+			}
+			mj.Progress.Listed(obj.Size)
+			select {
+			case objects <- sequencedObject{obj: obj, seq: seq, position: position - 1}:
+				seq++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	summary := NewSummary()
+	var matched []string
+	reorder := NewReorderBuffer(mj.Output)
+	for result := range results {
+		if mj.OrderedOutput {
+			reorder.Add(result)
+		}
+		key := mj.DisplayKey(result.Object.Key)
+		mj.Progress.Finished(result.Object.Size)
+		switch {
+		case result.Err != nil && ctx.Err() != nil:
+			// cancelled mid-search, which says nothing about the object, so
+			// it is left unfinished for a resumed search to try again
+			continue
+		case result.Err != nil:
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", key, result.Err))
+			if !mj.QuietErrors && !mj.ListErrors {
+				mj.Progress.Logf("%s: %v\n", mj.safe(key), result.Err)
+			}
+			// matches printed before a truncated object failed still count
+			if result.Matches > 0 {
+				mj.Counts.Add(key, result.Matches)
+				summary.Matches += result.Matches
+			}
+		case !result.Skipped:
+			mj.Counts.Add(key, result.Matches)
+			if mj.GroupDepth > 0 {
+				mj.Groups.Add(mj.DisplayKey(mj.Context.Prefixes.Group(result.Object.Key, mj.GroupDepth)), result.Matches)
+			}
+			mj.Progress.Object(mj.safe(key), result.Matches)
+			if result.Matches > 0 {
+				matched = append(matched, result.Object.Key)
+			}
+			summary.Bytes += result.Object.Size
+			summary.Objects++
+			summary.Matches += result.Matches
+		}
+		finished(result.position)
+	}
+	reorder.Flush()
+	if err := <-listErr; err != nil && ctx.Err() == nil {
+		return summary, fmt.Errorf("listing %s: %v", *mj.Context.Bucket, err)
+	}
+	if mj.Action != nil {
+		summary.Errors = append(summary.Errors, mj.ApplyAction(ctx, matched)...)
+	}
+	return summary, nil
+}
+
+// ForBucket returns a copy of the job operating on a single bucket. Output,
+// counters and cancellation are shared with the original job, while each
+// bucket of a multi-bucket search gets its own checkpoint file
+func (mj *MatchJob) ForBucket(bucket string) *MatchJob {
+	job := *mj
+	job.Context = mj.Context.WithBucket(bucket)
+	if mj.Checkpoint != nil && mj.qualifyKeys {
+		job.Checkpoint = &Checkpoint{Filename: mj.Checkpoint.Filename + "." + bucket}
+	}
+	return &job
+}
+
+// DisplayKey returns an object key as shown in output, qualified with its
+// bucket name when searching more than one bucket
+func (mj *MatchJob) DisplayKey(key string) string {
+	if mj.qualifyKeys {
+		return *mj.Context.Bucket + "/" + key
+	}
+	return key
+}
+
+// MatchedKey returns an object's display key, in KeyColor and annotated with
+// its size and storage class from the listing if ShowMeta is set. Control
+// characters in the key are escaped if SafeOutput is set
+func (mj *MatchJob) MatchedKey(obj ObjectInfo) string {
+	key := Colorize(mj.KeyColor, mj.safe(mj.DisplayKey(obj.Key)))
+	if !mj.ShowMeta {
+		return key
+	}
+	class := obj.StorageClass
+	if class == "" {
+		class = "-"
+	}
+	return key + mj.FieldSeparator + strconv.FormatInt(obj.Size, 10) + mj.FieldSeparator + class
+}
+
+// parallelListings returns the number of buckets, or prefixes within a
+// bucket, which may be listed at once
+func (mj *MatchJob) parallelListings() int {
+	if mj.ParallelBuckets < 1 {
+		return 1
+	}
+	return mj.ParallelBuckets
+}
+
+// ReportEvery logs an interim summary of a search begun at start once every
+// interval until the returned function is called, which waits for any
+// report in progress so that none follows the final summary. It does
+// nothing if interval is zero
+func (mj *MatchJob) ReportEvery(start time.Time, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				objects, matches := mj.Progress.Counts()
+				elapsed := time.Since(start)
+				scanned := atomic.LoadInt64(mj.scanned)
+				mj.Progress.Logf("after %s: searched %d objects (%d MB decompressed, %.1f MB/s) and found %d matches\n",
+					RoundElapsed(elapsed), objects, scanned/1048576, float64(scanned)/1048576/elapsed.Seconds(), matches)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// RoundElapsed rounds an elapsed time for display, to the millisecond when
+// it is under a second and otherwise to the second
+func RoundElapsed(elapsed time.Duration) time.Duration {
+	if elapsed < time.Second {
+		return elapsed.Round(time.Millisecond)
+	}
+	return elapsed.Round(time.Second)
+}
+
+// Search searches every configured bucket, at most ParallelBuckets at a
+// time, returning a summary of the whole search. With a GroupDepth, match
+// counts grouped by key prefix are printed once searching is complete. If
+// any bucket cannot be listed, the rest of the search is cancelled and the
+// first such error is returned without a summary
+func (mj *MatchJob) Search(ctx context.Context) (*Summary, error) {
+	ctx, mj.cancel = context.WithCancel(ctx)
+	defer mj.cancel()
+	start := time.Now()
+	buckets := mj.Context.Buckets()
+	mj.qualifyKeys = len(buckets) > 1
+	mj.Progress.Listings(len(buckets))
+	stopInterim := mj.ReportEvery(start, mj.SummaryInterval)
+	summaries := make(chan *Summary, len(buckets))
+	errs := make(chan error, len(buckets))
+	slots := make(chan struct{}, mj.parallelListings())
+	var wg sync.WaitGroup
+	for _, bucket := range buckets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(job *MatchJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			summary, err := job.ListContentMatches(ctx)
+			if err != nil {
+				errs <- err
+				mj.cancel()
+			}
+			summaries <- summary
+		}(mj.ForBucket(bucket))
+	}
+	wg.Wait()
+	stopInterim()
+	close(summaries)
+	close(errs)
+	if err := <-errs; err != nil {
+		mj.Progress.Done()
+		return nil, err
+	}
+	summary := NewSummary()
+	for bucketSummary := range summaries {
+		summary.Add(bucketSummary)
+	}
+	summary.KeyMatches = mj.Counts.Snapshot()
+	if mj.GroupDepth > 0 {
+		summary.GroupMatches = mj.Groups.Snapshot()
+	}
+	summary.DecompressedBytes = atomic.LoadInt64(mj.scanned)
+	summary.Warnings = int(atomic.LoadInt64(mj.warnings))
+	summary.ElapsedSeconds = time.Since(start).Seconds()
+	if mj.Count {
+		for _, key := range mj.Counts.Keys() {
+			count := summary.KeyMatches[key]
+			if mj.OutputFormat == outputNDJSON {
+				mj.Output.Printf("%s\n", Record{Key: key, Count: &count}.JSON())
+				continue
+			}
+			mj.Output.Printf("%s%s%d\n", mj.safe(key), mj.FieldSeparator, count)
+		}
+	}
+	if mj.GroupDepth > 0 {
+		for _, group := range mj.Groups.Keys() {
+			count := summary.GroupMatches[group]
+			if mj.OutputFormat == outputNDJSON {
+				mj.Output.Printf("%s\n", Record{Group: group, Count: &count}.JSON())
+				continue
+			}
+			mj.Output.Printf("group%s%s%s%d\n", mj.FieldSeparator, mj.safe(group), mj.FieldSeparator, count)
+		}
+	}
+	if mj.Duplicates != nil {
+		mj.PrintDuplicates()
+	}
+	if mj.Histogram != nil {
+		mj.PrintHistogram()
+	}
+	if mj.LineStats != nil {
+		report := mj.LineStats.Report()
+		summary.LineStats = &report
+		if mj.OutputFormat == outputNDJSON {
+			mj.Output.Printf("%s\n", Record{LineStats: &report}.JSON())
+		} else {
+			mj.Output.Printf("line-stats%s%s\n", mj.FieldSeparator, report)
+		}
+	}
+	mj.Progress.Done()
+	fmt.Fprintf(os.Stderr, "searched %d MB logs (%d MB decompressed) in %d objects and found %d matches",
+		summary.Bytes/1048576, summary.DecompressedBytes/1048576, summary.Objects, summary.Matches)
+	if len(summary.Errors) > 0 || summary.Warnings > 0 {
+		fmt.Fprintf(os.Stderr, ", with %d errors and %d warnings", len(summary.Errors), summary.Warnings)
+	}
+	fmt.Fprintln(os.Stderr)
+	return summary, nil
+}
+
+// PrintDuplicates writes each matching line found in more than one object,
+// followed by the keys of those objects
+func (mj *MatchJob) PrintDuplicates() {
+	for _, duplicate := range mj.Duplicates.Duplicates() {
+		if mj.OutputFormat == outputNDJSON {
+			mj.Output.Printf("%s\n", Record{Match: duplicate.Line, Keys: duplicate.Keys}.JSON())
+			continue
+		}
+		mj.Output.Printf("duplicate%s%d%s%s\n", mj.FieldSeparator, len(duplicate.Keys), mj.FieldSeparator, mj.safe(duplicate.Line))
+		for _, key := range duplicate.Keys {
+			mj.Output.Printf("\t%s\n", mj.safe(key))
+		}
+	}
+}
+
+// PrintHistogram writes the number of matching lines in each interval of
+// the histogram, with a bar showing its size relative to the largest
+func (mj *MatchJob) PrintHistogram() {
+	buckets := mj.Histogram.Buckets()
+	max := 0
+	for _, bucket := range buckets {
+		if bucket.Count > max {
+			max = bucket.Count
+		}
+	}
+	for _, bucket := range buckets {
+		start := bucket.Start.Format(time.RFC3339)
+		if mj.OutputFormat == outputNDJSON {
+			count := bucket.Count
+			mj.Output.Printf("%s\n", Record{Time: start, Count: &count}.JSON())
+			continue
+		}
+		mj.Output.Printf("%s%s%d%s%s\n", start, mj.FieldSeparator, bucket.Count, mj.FieldSeparator, Bar(bucket.Count, max))
+	}
+}
+
+// ReadPattern reads a pattern from the first line of a file, prompting on
+// stderr if the file is a terminal
+func ReadPattern(file *os.File) (string, error) {
+	if IsTerminal(file) {
+		fmt.Fprint(os.Stderr, "content pattern: ")
+	}
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// ReadKeys reads a set of keys from a file, one per line, ignoring blank
+// lines
+func ReadKeys(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := strings.TrimRight(scanner.Text(), "\r"); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// Exit statuses used when a search is cut short by -deadline or by SIGINT
+// or SIGTERM
+const (
+	exitTimedOut    = 3
+	exitInterrupted = 130
+)
+
+func main() {
+	app := NewAppContext()
+	showkeys := flag.Bool("show-keys", false, "Include S3 keys with matching lines, like traditional grep")
+	var keymatch PatternList
+	flag.Var(&keymatch, "key-match", "Regular expression matched against S3 object keys; repeat to match any of several, or all with -key-match-all")
+	multipartOnly := flag.Bool("multipart-only", false, "Only search objects uploaded in several parts, judged by their listed ETag")
+	singlePartOnly := flag.Bool("single-part-only", false, "Only search objects uploaded in a single part, judged by their listed ETag")
+	keyDepth := flag.Int("key-depth", 0, "Only search keys with exactly this many slash-separated components, so 2 selects logs/app.log but not logs/2024/app.log")
+	keyMatchAll := flag.Bool("key-match-all", false, "Require keys to match every -key-match rather than any one")
+	contentmatch := flag.String("content-match", "", "Regular expression matched against object content; if empty, matching keys are listed instead")
+	ignoreCase := flag.Bool("i", false, "Match -content-match without regard to case")
+	var fixedStrings bool
+	flag.BoolVar(&fixedStrings, "F", false, "Treat -content-match as a literal string rather than a regular expression")
+	flag.BoolVar(&fixedStrings, "fixed-strings", false, "Same as -F")
+	keyIgnoreCase := flag.Bool("key-ignore-case", false, "Match -key-match without regard to case")
+	multiline := flag.Bool("multiline", false, "Match content across line boundaries by reading whole objects")
+	multilineMax := flag.Int64("multiline-max-bytes", 64*1048576, "Skip objects larger than this in -multiline and -whole-object modes")
+	recordSep := flag.String("record-separator", "", "Match records delimited by this string, taken literally, instead of lines")
+	recordSepEscapes := flag.Bool("record-separator-escapes", false, "Interpret Go escape sequences such as \\n and \\x00 in -record-separator")
+	selectExpr := flag.String("s3-select", "", "S3 Select SQL expression used to filter CSV, JSON and Parquet objects server-side")
+	rangeStart := flag.Int64("range-start", 0, "Download only the bytes of each object from this offset; implies -no-decompress, as compressed streams cannot be read from part way through")
+	rangeEnd := flag.Int64("range-end", 0, "Download only the bytes of each object up to and including this offset (0 for the end of the object); implies -no-decompress")
+	noDecompress := flag.Bool("no-decompress", false, "Search raw object bytes without transparent decompression; implies -a, as compressed bytes look binary")
+	var text bool
+	flag.BoolVar(&text, "a", false, "Search binary objects as if they were text")
+	flag.BoolVar(&text, "text", false, "Search binary objects as if they were text")
+	estimateCost := flag.Bool("estimate-cost", false, "Estimate request and transfer cost from listing only, then exit")
+	benchmark := flag.String("benchmark", "", "Search a sample of objects once at each of these comma-separated concurrency levels, report throughput, then exit")
+	benchmarkObjects := flag.Int("benchmark-objects", 100, "Number of objects sampled by -benchmark")
+	costPerGB := flag.Float64("cost-per-gb", 0.09, "Data transfer price per GB used by -estimate-cost")
+	costPer1000 := flag.Float64("cost-per-1000-requests", 0.0004, "GET request price per 1000 used by -estimate-cost")
+	maxDecompressed := flag.Int64("max-decompressed-bytes", 0, "Skip the rest of an object once it decompresses to more than this many bytes (0 for no limit)")
+	matchTimeout := flag.Duration("match-timeout", 0, "Stop matching an object after this long, such as 30s, reporting it as failed but keeping matches found so far (0 for no limit)")
+	outputBufferSize := flag.Int("output-buffer-size", 65536, "Size in bytes of the buffer used for match output")
+	check := flag.Bool("check", false, "Verify credentials, region and bucket access, then exit")
+	deadline := flag.Duration("deadline", 0, "Cancel the search after this long, e.g. 10m (0 for no limit)")
+	replace := flag.String("replace", "", "Rewrite matched text using this template before printing; $1 etc. refer to capture groups")
+	includeEmpty := flag.Bool("include-empty", false, "Search zero-byte objects, which are skipped by default")
+	maxLines := flag.Int64("max-lines", 0, "Stop searching after printing this many matching lines in total (0 for no limit)")
+	summaryJSON := flag.String("summary-json", "", "Write a JSON summary of the search to this file")
+	checkpointFile := flag.String("checkpoint-file", "", "Resume listing from, and periodically save, the continuation token in this file")
+	wholeObject := flag.Bool("whole-object", false, "Match content once against each whole object and print matching keys")
+	showTimestamps := flag.Bool("show-timestamps", false, "Prefix matching lines with the object's last-modified time")
+	count := flag.Bool("count", false, "Print only a count of matching lines per object, like grep -c")
+	owner := flag.String("owner", "", "Only search objects owned by this canonical user ID or display name")
+	aclPublic := flag.Bool("acl-public", false, "Only search objects whose ACL grants public or any-AWS-user read access")
+	checksum := flag.String("checksum", "", "Only search objects whose checksum is [algorithm:]value, or with a leading ! is not; algorithm is etag (default), crc32, crc32c, sha1 or sha256")
+	outputFile := flag.String("output-file", "", "Write matches to this file instead of stdout, gzip-compressed if it ends in .gz")
+	outputAppend := flag.Bool("output-append", false, "Append to -output-file instead of replacing it, such as when resuming from a checkpoint")
+	parallelBuckets := flag.Int("parallel-buckets", 1, "Maximum number of buckets, and of prefixes within each bucket, to search concurrently")
+	orderedOutput := flag.Bool("ordered-output", false, "Print each object's matching lines in listing order, holding back those of objects searched early until the objects listed before them are done")
+	includeSpans := flag.Bool("include-spans", false, "With -output ndjson, include the [start,end] byte offsets of each match within the matching line")
+	groupOutput := flag.Bool("group-output", false, "Print each object's matching lines together under a === key === header rather than as they are found")
+	progressBar := flag.Bool("show-progress-bar", false, "On a terminal, show a bar of the share of listed bytes searched, estimated until listing completes")
+	quietErrors := flag.Bool("quiet-errors", false, "Only count objects which fail or are skipped, rather than reporting each one; totals are still given, and failures still make the exit status 1")
+	listErrors := flag.Bool("list-errors", false, "List objects which cannot be downloaded or decompressed, with the reason, instead of matches")
+	sampleRate := flag.Float64("sample-rate", 1, "Search only this fraction of selected objects, chosen at random")
+	sampleSeed := flag.Int64("sample-seed", 0, "Seed making -sample-rate select the same objects on every run (default random)")
+	trimSpace := flag.Bool("trim-space", false, "Trim leading and trailing whitespace from lines before matching")
+	showTrimmed := flag.Bool("show-trimmed", false, "Print lines as trimmed by -trim-space rather than as found")
+	var minSize ByteSize
+	flag.Var(&minSize, "min-size", "Only search objects of at least this size, such as 512K or 1MB")
+	var maxTotalBytes ByteSize
+	flag.Var(&maxTotalBytes, "max-total-bytes", "Stop searching once more than this many bytes, such as 1GB, have been downloaded in total")
+	since := flag.String("since", "", "Only search objects modified at or after this RFC 3339 time, or this long ago such as 24h")
+	until := flag.String("until", "", "Only search objects modified at or before this RFC 3339 time, or this long ago such as 1h")
+	skipLargerThan := flag.Int64("skip-larger-than", 0, "Skip, with a warning, objects larger than this many bytes (0 for no limit)")
+	keysFromCSV := flag.String("keys-from-csv", "", "Search only the keys in a column of this CSV file, such as an Athena query result; its first row is taken as a header")
+	keyColumn := flag.Int("key-column", 1, "1-based column of -keys-from-csv holding keys, searched in every bucket, or s3://bucket/key URLs naming one of -bucket")
+	inventoryManifest := flag.String("inventory-manifest", "", "Enumerate objects from this S3 Inventory manifest.json (s3://bucket/key) instead of listing")
+	fieldSeparator := flag.String("field-separator", ":", "Separator between the key and the matching line or count")
+	nullSeparator := flag.Bool("0", false, "Separate keys from matching lines or counts with a NUL byte, and end keys listed alone with one, for safe machine parsing")
+	flag.BoolVar(nullSeparator, "Z", false, "Same as -0, like grep -Z")
+	flag.BoolVar(nullSeparator, "null", false, "Same as -0")
+	decompressCmd := flag.String("decompress-cmd", "", "Pipe each object through this shell command, e.g. 'lzop -dc', and search its output")
+	peek := flag.Int("peek", 0, "Also print the first N lines of each object with a match, prefixed with peek")
+	matchWorkers := flag.Int("match-workers", 1, "Match objects larger than 1 MB using this many goroutines, each taking a chunk of lines at a time")
+	prettyJSON := flag.Bool("pretty-json", false, "Indent matching lines which hold a JSON object or array over several lines for readability")
+	lineStats := flag.Bool("line-stats", false, "After searching, report the count, minimum, maximum, mean and percentiles of the lengths of all lines read, matching or not")
+	filterExpr := flag.String("filter-expr", "", "Only match lines for which this expr-lang expression is true, such as 'len(line) > 100 && line contains \"ERROR\"'; json holds the fields of JSON lines")
+	histogram := flag.Duration("histogram", 0, "After searching, print how many matching lines fall in each interval of this length, such as 1h, by their timestamps")
+	timestampRegex := flag.String("timestamp-regex", defaultTimestampRegex, "Regular expression finding the timestamp in each line for -histogram, taken from its first capture group if it has one")
+	reportDuplicates := flag.Bool("report-duplicates", false, "After searching, report matching lines found in more than one object, with their keys; holds every distinct matching line in memory")
+	ageIdentity := flag.String("age-identity", "", "File of age identities used to decrypt objects whose keys end in .age")
+	contentMatchEnv := flag.String("content-match-env", "", "Read the content pattern from this environment variable, keeping it out of the process arguments")
+	stdinPattern := flag.Bool("stdin-pattern", false, "Read the content pattern from the first line of stdin instead of -content-match")
+	memberMatch := flag.String("member-match", "", "Regular expression matched against member names in tar and zip archives")
+	lineStart := flag.Int64("line-start", 0, "Only match lines from this 1-based line number onwards in each object")
+	lineEnd := flag.Int64("line-end", 0, "Only match lines up to this 1-based line number in each object (0 for no limit)")
+	action := flag.String("action", "", "Apply delete or tag:key=value to each object with a match; requires -confirm")
+	confirm := flag.Bool("confirm", false, "Confirm that -action may modify objects")
+	dryRun := flag.Bool("dry-run", false, "Describe what -action would do without modifying objects")
+	actionRate := flag.Float64("action-rate", 10, "Maximum requests per second made by -action")
+	groupDepth := flag.Int("group-by-prefix-depth", 0, "Print match counts grouped by the prefix and this many following path segments of each key")
+	fieldDelimiter := flag.String("field-delimiter", ",", "Delimiter splitting lines into fields for -match-field and -csv")
+	csvMode := flag.Bool("csv", false, "Parse objects as CSV and match each field, printing the row and column of matching fields")
+	matchField := flag.Int("match-field", 0, "Apply -content-match only to this 1-based field of each line, skipping lines with fewer fields")
+	excludeKeysFrom := flag.String("exclude-keys-from", "", "File of keys, one per line, which are not searched, such as the output of an earlier run")
+	safeOutput := flag.String("safe-output", colorAuto, "Escape control characters in printed lines and keys as \\xNN: auto (when stdout is a terminal), always or never")
+	color := flag.String("color", colorAuto, "Colour keys and matches: auto (when stdout is a terminal), always or never")
+	colorKeys := flag.String("color-keys", "35", "ANSI SGR code colouring keys, such as 35 for magenta; empty to leave keys plain")
+	colorMatch := flag.String("color-match", "1;31", "ANSI SGR code colouring matched text, such as 1;31 for bold red; empty to leave matches plain")
+	outputFormat := flag.String("output", outputText, "Output format: text, ndjson for one JSON record per result, flushed as it is written, or es-bulk for ndjson records each preceded by an Elasticsearch bulk index action")
+	esIndex := flag.String("es-index", "", "Elasticsearch index named in -output es-bulk actions (default the index in the _bulk URL)")
+	summaryInterval := flag.Duration("summary-interval", 0, "Print an interim summary to stderr this often, such as 1m, during long searches")
+	showMeta := flag.Bool("show-meta", false, "Show each matching key with its size and storage class")
+	printFields := flag.String("print-fields", "", "Comma-separated fields, or dotted paths, whose values are printed before each matching JSON line")
+	format := flag.String("format", "", "Parse lines as cef or syslog, skipping lines which do not parse")
+	var fields FieldMatches
+	flag.Var(&fields, "cef-field", "Only match lines whose parsed field matches, as name=regex (repeatable)")
+	concurrency := flag.Int("concurrency", 32, "Number of objects to search concurrently in each bucket")
+	maxBuffer := flag.Int64("max-buffer-bytes", 0, "Limit memory used across all workers to buffer objects for -multiline and -match-workers, and zip archives, to this many bytes, spooling zip archives to -spool-dir and skipping other objects with a warning beyond it (0 for no limit)")
+	spoolDir := flag.String("spool-dir", "", "Directory for temporary copies of zip archives (default the system temporary directory)")
+	flag.Parse()
+	if *app.PrefixFile != "" {
+		if err := app.Prefixes.ReadFile(*app.PrefixFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if (*app.DateRange == "") != (*app.PartitionFormat == "") {
+		fmt.Fprintln(os.Stderr, "-date-range and -partition-format must be used together")
+		os.Exit(2)
+	}
+	if *app.DateRange != "" {
+		if err := app.Prefixes.AddPartitions(*app.PartitionFormat, *app.DateRange); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if err := app.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := app.Connect(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *check {
+		if err := app.Check(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+		return
+	}
+	ranged := *rangeStart > 0 || *rangeEnd > 0
+	partFilter := *multipartOnly || *singlePartOnly
+	if !app.UsesS3() && (*aclPublic || *action != "" || *checksum != "" || *inventoryManifest != "" || *selectExpr != "" || ranged || partFilter || *app.ClientSideEncryption) {
+		fmt.Fprintln(os.Stderr, "-acl-public, -action, -checksum, -inventory-manifest, -s3-select, -range-start, -range-end, -multipart-only, -single-part-only and -client-side-encryption require S3")
+		os.Exit(2)
+	}
+	if *stdinPattern {
+		if *contentmatch != "" {
+			fmt.Fprintln(os.Stderr, "-stdin-pattern and -content-match cannot be used together")
+			os.Exit(2)
+		}
+		pattern, err := ReadPattern(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		*contentmatch = pattern
+	}
+	if *contentMatchEnv != "" {
+		pattern, ok := os.LookupEnv(*contentMatchEnv)
+		if *contentmatch != "" || *stdinPattern || !ok {
+			fmt.Fprintf(os.Stderr, "-content-match-env requires %s to be set, and cannot be used with -content-match or -stdin-pattern\n", *contentMatchEnv)
+			os.Exit(2)
+		}
+		// not passed on to -decompress-cmd
+		os.Unsetenv(*contentMatchEnv)
+		*contentmatch = pattern
+	}
+	// with only a filter expression, every line is a candidate
+	searchContent := *contentmatch != "" || *filterExpr != ""
+	if len(keymatch) == 0 && !searchContent {
+		fmt.Fprintln(os.Stderr, "at least one of -key-match, -content-match and -filter-expr is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	keyPatterns := keymatch.List()
+	if *keyIgnoreCase {
+		for i := range keyPatterns {
+			keyPatterns[i] = "(?i)" + keyPatterns[i]
+		}
+	}
+	if fixedStrings {
+		*contentmatch = regexp.QuoteMeta(*contentmatch)
+	}
+	if *ignoreCase && *contentmatch != "" {
+		*contentmatch = "(?i)" + *contentmatch
+	}
+	mj := NewMatchJob(app, keyPatterns[0], *contentmatch)
+	for _, pattern := range keyPatterns[1:] {
+		mj.AddNameMatch(pattern)
+	}
+	mj.NameMatchAll = *keyMatchAll
+	if *keyDepth < 0 {
+		fmt.Fprintln(os.Stderr, "-key-depth must not be negative")
+		os.Exit(2)
+	}
+	mj.KeyDepth = *keyDepth
+	if *multipartOnly && *singlePartOnly {
+		fmt.Fprintln(os.Stderr, "-multipart-only and -single-part-only cannot be used together")
+		os.Exit(2)
+	}
+	mj.MultipartOnly = *multipartOnly
+	mj.SinglePartOnly = *singlePartOnly
+	mj.SetShowKeys(showkeys)
+	mj.ShowTimestamps = *showTimestamps
+	mj.Count = *count
+	mj.Owner = *owner
+	mj.ACLPublic = *aclPublic
+	if *checksum != "" {
+		filter, err := ParseChecksumFilter(*checksum)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.Checksum = filter
+	}
+	mj.SelectExpression = *selectExpr
+	mj.NoDecompress = *noDecompress
+	mj.Text = text
+	mj.MaxDecompressedBytes = *maxDecompressed
+	mj.MatchTimeout = *matchTimeout
+	if ranged {
+		if *rangeStart < 0 || (*rangeEnd > 0 && *rangeEnd < *rangeStart) {
+			fmt.Fprintln(os.Stderr, "-range-end must not be before -range-start")
+			os.Exit(2)
+		}
+		if *app.ClientSideEncryption {
+			fmt.Fprintln(os.Stderr, "-range-start and -range-end cannot be used with -client-side-encryption")
+			os.Exit(2)
+		}
+		mj.Range = fmt.Sprintf("bytes=%d-", *rangeStart)
+		if *rangeEnd > 0 {
+			mj.Range += strconv.FormatInt(*rangeEnd, 10)
+		}
+		mj.NoDecompress = true
+	}
+	mj.Replacement = *replace
+	mj.IncludeEmpty = *includeEmpty
+	mj.MaxLines = *maxLines
+	mj.ParallelBuckets = *parallelBuckets
+	mj.Concurrency = *concurrency
+	mj.SkipLargerThan = *skipLargerThan
+	mj.MinSize = int64(minSize)
+	mj.MaxTotalBytes = int64(maxTotalBytes)
+	if mj.SkipLargerThan > 0 && mj.MinSize > mj.SkipLargerThan {
+		fmt.Fprintln(os.Stderr, "-min-size must not exceed -skip-larger-than")
+		os.Exit(2)
+	}
+	now := time.Now()
+	var err error
+	if mj.Since, err = ParseTimeBound(*since, now); err != nil {
+		fmt.Fprintln(os.Stderr, "-since:", err)
+		os.Exit(2)
+	}
+	if mj.Until, err = ParseTimeBound(*until, now); err != nil {
+		fmt.Fprintln(os.Stderr, "-until:", err)
+		os.Exit(2)
+	}
+	if !mj.Since.IsZero() && !mj.Until.IsZero() && mj.Since.After(mj.Until) {
+		fmt.Fprintln(os.Stderr, "-since must not be later than -until")
+		os.Exit(2)
+	}
+	mj.InventoryManifest = *inventoryManifest
+	if *keysFromCSV != "" {
+		if *keyColumn < 1 || *inventoryManifest != "" || *checkpointFile != "" {
+			fmt.Fprintln(os.Stderr, "-key-column must be at least 1, and -keys-from-csv cannot be used with -inventory-manifest or -checkpoint-file")
+			os.Exit(2)
+		}
+		keys, err := ReadKeysCSV(*keysFromCSV, *keyColumn, app.Buckets())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.KeyList = keys
+	}
+	mj.LineStart = *lineStart
+	mj.MemberMatch = regexp.MustCompile(*memberMatch)
+	if *ageIdentity != "" {
+		identities, err := ReadAgeIdentities(*ageIdentity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.AgeIdentities = identities
+	}
+	mj.SpoolDir = *spoolDir
+	if *maxBuffer > 0 {
+		mj.Buffers = NewBufferBudget(*maxBuffer)
+	}
+	mj.Peek = *peek
+	if *matchField < 0 || *fieldDelimiter == "" {
+		fmt.Fprintln(os.Stderr, "-match-field must not be negative, and -field-delimiter must not be empty")
+		os.Exit(2)
+	}
+	if *csvMode && utf8.RuneCountInString(*fieldDelimiter) != 1 {
+		fmt.Fprintln(os.Stderr, "-csv requires a single character -field-delimiter")
+		os.Exit(2)
+	}
+	mj.MatchField = *matchField
+	mj.FieldDelimiter = *fieldDelimiter
+	mj.CSV = *csvMode
+	mj.GroupDepth = *groupDepth
+	if *reportDuplicates {
+		if *multiline || *wholeObject || *csvMode {
+			fmt.Fprintln(os.Stderr, "-report-duplicates compares lines, so cannot be used with -multiline, -whole-object or -csv")
+			os.Exit(2)
+		}
+		mj.Duplicates = NewLineKeys()
+	}
+	mj.ShowMeta = *showMeta
+	mj.PrettyJSON = *prettyJSON
+	mj.MatchWorkers = *matchWorkers
+	mj.QuietErrors = *quietErrors
+	if *filterExpr != "" {
+		if *multiline || *wholeObject || *csvMode {
+			fmt.Fprintln(os.Stderr, "-filter-expr applies to lines, so cannot be used with -multiline, -whole-object or -csv")
+			os.Exit(2)
+		}
+		filter, err := CompileLineFilter(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-filter-expr:", err)
+			os.Exit(2)
+		}
+		mj.Filter = filter
+	}
+	if *histogram > 0 {
+		if *multiline || *wholeObject || *csvMode {
+			fmt.Fprintln(os.Stderr, "-histogram counts lines, so cannot be used with -multiline, -whole-object or -csv")
+			os.Exit(2)
+		}
+		regex, err := regexp.Compile(*timestampRegex)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-timestamp-regex:", err)
+			os.Exit(2)
+		}
+		mj.Histogram = NewHistogram(regex, *histogram)
+	}
+	if *lineStats {
+		if *multiline || *wholeObject || *csvMode || !searchContent {
+			fmt.Fprintln(os.Stderr, "-line-stats counts the lines of objects searched for content, so requires -content-match or -filter-expr and cannot be used with -multiline, -whole-object or -csv")
+			os.Exit(2)
+		}
+		mj.LineStats = NewLineStats()
+	}
+	mj.SummaryInterval = *summaryInterval
+	bulkAction := ""
+	switch *outputFormat {
+	case outputText, outputNDJSON:
+		mj.OutputFormat = *outputFormat
+	case outputESBulk:
+		// bulk requests are ndjson with an action line before each record
+		mj.OutputFormat = outputNDJSON
+		bulkAction = ESBulkAction(*esIndex)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *outputFormat)
+		os.Exit(2)
+	}
+	if *esIndex != "" && *outputFormat != outputESBulk {
+		fmt.Fprintln(os.Stderr, "-es-index requires -output es-bulk")
+		os.Exit(2)
+	}
+	if *outputFormat == outputESBulk && *listErrors {
+		fmt.Fprintln(os.Stderr, "-list-errors prints plain text, so cannot be used with -output es-bulk")
+		os.Exit(2)
+	}
+	if *groupOutput && mj.OutputFormat == outputNDJSON {
+		fmt.Fprintln(os.Stderr, "-group-output cannot be used with -output ndjson, whose records each name their object")
+		os.Exit(2)
+	}
+	mj.GroupOutput = *groupOutput
+	mj.OrderedOutput = *orderedOutput
+	if *includeSpans {
+		if mj.OutputFormat != outputNDJSON || *contentmatch == "" {
+			fmt.Fprintln(os.Stderr, "-include-spans requires -output ndjson and -content-match")
+			os.Exit(2)
+		}
+		if *replace != "" || *matchField > 0 || *printFields != "" || *csvMode || *prettyJSON || *trimSpace {
+			fmt.Fprintln(os.Stderr, "-include-spans gives offsets within matching lines as found, so cannot be used with -replace, -match-field, -print-fields, -csv, -pretty-json or -trim-space")
+			os.Exit(2)
+		}
+		mj.IncludeSpans = true
+	}
+	if *excludeKeysFrom != "" {
+		keys, err := ReadKeys(*excludeKeysFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.ExcludeKeys = keys
+	}
+	for _, field := range strings.Split(*printFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			mj.PrintFields = append(mj.PrintFields, field)
+		}
+	}
+	mj.DecompressCommand = *decompressCmd
+	mj.FieldSeparator = *fieldSeparator
+	if *nullSeparator {
+		mj.FieldSeparator = "\x00"
+		mj.NullKeys = true
+	}
+	mj.LineEnd = *lineEnd
+	mj.TrimSpace = *trimSpace
+	mj.ShowTrimmed = *showTrimmed
+	mj.SampleRate = *sampleRate
+	mj.SampleSeed = *sampleSeed
+	if mj.SampleSeed == 0 {
+		mj.SampleSeed = time.Now().UnixNano()
+	}
+	if *checkpointFile != "" {
+		if len(app.Prefixes) > 1 {
+			fmt.Fprintln(os.Stderr, "-checkpoint-file cannot be used with more than one prefix")
+			os.Exit(2)
+		}
+		mj.Checkpoint = &Checkpoint{Filename: *checkpointFile}
+	}
+	if *multiline {
+		mj.SetMultiline(*multilineMax)
+	}
+	if *wholeObject {
+		mj.SetWholeObject(*multilineMax)
+	}
+	if *recordSep != "" {
+		sep := *recordSep
+		if *recordSepEscapes {
+			var err error
+			if sep, err = UnescapeSeparator(sep); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}
+		if err := mj.SetRecordSeparator(sep); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *format != "" || len(fields) > 0 {
+		if err := mj.SetFormat(*format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.Fields = fields
+	}
+	if *action != "" {
+		parsed, err := NewAction(*action, *confirm, *dryRun, *actionRate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		mj.Action = parsed
+	}
+	mj.Progress = NewProgress(os.Stderr, IsTerminal(os.Stderr))
+	mj.Progress.Bar = *progressBar
+	stdout := io.Writer(os.Stdout)
+	if IsTerminal(os.Stdout) {
+		stdout = mj.Progress.Writer(os.Stdout)
+	}
+	mj.Output = NewOutput(stdout, *outputBufferSize)
+	if *outputFile != "" {
+		output, err := CreateOutputFile(*outputFile, *outputBufferSize, *outputAppend)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		mj.Output = output
+	}
+	mj.Output.LineFlush = mj.OutputFormat == outputNDJSON
+	mj.Output.RecordPrefix = bulkAction
+	switch *color {
+	case colorAlways:
+	case colorAuto:
+		if !IsTerminal(os.Stdout) || *outputFile != "" {
+			*colorKeys, *colorMatch = "", ""
+		}
+	case colorNever:
+		*colorKeys, *colorMatch = "", ""
+	default:
+		fmt.Fprintf(os.Stderr, "unknown color mode %q\n", *color)
+		os.Exit(2)
+	}
+	var safe bool
+	switch *safeOutput {
+	case colorAlways:
+		safe = true
+	case colorAuto:
+		safe = IsTerminal(os.Stdout) && *outputFile == ""
+	case colorNever:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -safe-output mode %q\n", *safeOutput)
+		os.Exit(2)
+	}
+	// JSON encoding escapes control characters itself
+	if mj.OutputFormat == outputText {
+		mj.SafeOutput = safe
+		mj.KeyColor = *colorKeys
+		mj.MatchColor = *colorMatch
+	}
+	defer mj.Output.Close()
+	go mj.Output.FlushEvery(time.Second)
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		interrupt()
+		<-signals
+		mj.Output.Close()
+		mj.Progress.Done()
+		os.Exit(exitInterrupted)
+	}()
+	exitIfInterrupted := func() {
+		if ctx.Err() == context.Canceled {
+			fmt.Fprintln(os.Stderr, "interrupted, results are partial")
+			mj.Output.Close()
+			os.Exit(exitInterrupted)
+		}
+	}
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+	exitIfFailed := func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			mj.Output.Close()
+			os.Exit(1)
+		}
+	}
+	if *estimateCost {
+		err := mj.EstimateCost(ctx, *costPerGB, *costPer1000)
+		exitIfInterrupted()
+		exitIfFailed(err)
+		return
+	}
+	if *benchmark != "" {
+		levels, err := ParseLevels(*benchmark)
+		if err != nil || !searchContent {
+			fmt.Fprintln(os.Stderr, "-benchmark requires -content-match or -filter-expr, and a list of concurrency levels such as 1,8,32")
+			os.Exit(2)
+		}
+		err = mj.Benchmark(ctx, levels, *benchmarkObjects)
+		exitIfInterrupted()
+		exitIfFailed(err)
+		return
+	}
+	if !searchContent {
+		err := mj.JustListNameMatches(ctx)
+		exitIfInterrupted()
+		exitIfFailed(err)
+		return
+	}
+	if *listErrors {
+		mj.ListErrors = true
+		mj.Text = true
+		summary, err := mj.Search(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			mj.Output.Close()
+			os.Exit(1)
+		}
+		for _, objErr := range summary.Errors {
+			mj.Output.Printf("%s\n", mj.safe(objErr))
+		}
+		exitIfInterrupted()
+		if len(summary.Errors) > 0 {
+			mj.Output.Close()
+			os.Exit(1)
+		}
+		return
+	}
+	summary, err := mj.Search(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		mj.Output.Close()
+		os.Exit(1)
+	}
+	if *summaryJSON != "" {
+		if err := summary.WriteJSON(*summaryJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	exitIfInterrupted()
+	if ctx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(os.Stderr, "timed out after %v, results are partial\n", *deadline)
+		mj.Output.Close()
+		os.Exit(exitTimedOut)
+	}
+	if len(summary.Errors) > 0 {
+		mj.Output.Close()
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newTestJob creates a job searching source for cmatch, with progress
+// discarded and output collected in the returned buffer, which holds
+// everything written once Search returns
+func newTestJob(source ObjectSource, cmatch string) (*MatchJob, *bytes.Buffer) {
+	ctx := &AppContext{
+		Bucket:               aws.String("bucket"),
+		SourceURL:            aws.String(""),
+		Backend:              aws.String(backendS3),
+		ClientSideEncryption: aws.Bool(false),
+		Source:               source,
+	}
+	mj := NewMatchJob(ctx, "", cmatch)
+	output := &bytes.Buffer{}
+	mj.Output = NewOutput(output, 4096)
+	mj.Output.LineFlush = true
+	mj.Progress = NewProgress(ioutil.Discard, false)
+	return mj, output
+}
+
+// gzipped compresses text, dropping the last drop bytes of the result
+func gzipped(t *testing.T, text string, drop int) string {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer.Bytes()[:buffer.Len()-drop])
+}
+
+func TestSearch(t *testing.T) {
+	source := memSource{
+		"a.log": "one hit\nmiss\ntwo hit\n",
+		"b.log": "miss\n",
+		"c.gz":  "three hit\n",
+	}
+	source["c.gz"] = gzipped(t, source["c.gz"], 0)
+	tests := []struct {
+		name    string
+		setup   func(mj *MatchJob)
+		want    string
+		matches int
+	}{
+		{"lines", func(mj *MatchJob) {}, "one hit\ntwo hit\nthree hit\n", 3},
+		{"keys", func(mj *MatchJob) { mj.ShowKeys = true }, "a.log:one hit\na.log:two hit\nc.gz:three hit\n", 3},
+		{"count", func(mj *MatchJob) { mj.Count = true }, "a.log:2\nb.log:0\nc.gz:1\n", 3},
+		{"max lines", func(mj *MatchJob) { mj.MaxLines = 1 }, "one hit\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(source, "hit")
+			tt.setup(mj)
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			if summary.Matches != tt.matches {
+				t.Errorf("found %d matches, want %d", summary.Matches, tt.matches)
+			}
+		})
+	}
+}
+
+func TestSearchTruncatedGzip(t *testing.T) {
+	source := memSource{
+		"bad.gz": gzipped(t, strings.Repeat("bad hit\n", 10000), 8),
+		"ok.log": "ok hit\n",
+	}
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+		want  string
+	}{
+		{"list errors", func(mj *MatchJob) { mj.ListErrors = true }, ""},
+		{"count", func(mj *MatchJob) { mj.Count = true }, "bad.gz:10000\nok.log:1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(source, "hit")
+			tt.setup(mj)
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			if len(summary.Errors) != 1 || !strings.HasPrefix(summary.Errors[0], "bad.gz: "+ErrTruncated.Error()) {
+				t.Errorf("errors %q, want bad.gz truncated", summary.Errors)
+			}
+			if summary.Matches != 10001 {
+				t.Errorf("found %d matches, want 10001", summary.Matches)
+			}
+		})
+	}
+}
+
+func TestSearchSafeOutput(t *testing.T) {
+	source := memSource{
+		"a\x1b.log": `{"user":"eve\u001b[2J","msg":"hit"}` + "\n",
+	}
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+		want  string
+	}{
+		{"print fields", func(mj *MatchJob) { mj.PrintFields = []string{"user"} },
+			`eve\x1b[2J:{"user":"eve\u001b[2J","msg":"hit"}` + "\n"},
+		{"keys", func(mj *MatchJob) { mj.ShowKeys = true },
+			`a\x1b.log:{"user":"eve\u001b[2J","msg":"hit"}` + "\n"},
+		{"count", func(mj *MatchJob) { mj.Count = true }, `a\x1b.log:1` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(source, "hit")
+			mj.SafeOutput = true
+			tt.setup(mj)
+			if _, err := mj.Search(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRecordSeparator(t *testing.T) {
+	tests := []struct {
+		name    string
+		sep     string
+		escapes bool
+		text    string
+		want    []string
+	}{
+		{"newline in separator", "----\n", false, "a\nb\n----\nc\n----\n", []string{"a\nb\n", "c\n"}},
+		{"escaped newline", `----\n`, true, "a\n----\nb", []string{"a\n", "b"}},
+		{"literal backslash", `\n`, false, `a\nb`, []string{"a", "b"}},
+		{"nul", `\x00`, true, "a\x00b\x00", []string{"a", "b"}},
+		{"no separator", ";", false, "a\nb", []string{"a\nb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sep := tt.sep
+			if tt.escapes {
+				var err error
+				if sep, err = UnescapeSeparator(sep); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mj, _ := newTestJob(nil, "")
+			if err := mj.SetRecordSeparator(sep); err != nil {
+				t.Fatal(err)
+			}
+			scanner := bufio.NewScanner(strings.NewReader(tt.text))
+			scanner.Split(ScanRecords(mj.RecordSeparator))
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("records %q, want %q", got, tt.want)
+			}
+		})
+	}
+	mj, _ := newTestJob(nil, "")
+	if err := mj.SetRecordSeparator(""); err == nil {
+		t.Error("empty separator accepted")
+	}
+	if _, err := UnescapeSeparator(`\q`); err == nil {
+		t.Error("invalid escape accepted")
+	}
+}
+
+func TestSearchRecordSeparator(t *testing.T) {
+	source := memSource{"a.log": "first\nhit\n----\nsecond\nmiss\n----\nthird hit\n"}
+	mj, output := newTestJob(source, "hit")
+	if err := mj.SetRecordSeparator("----\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mj.Search(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output.String(), "first\nhit\n\nthird hit\n\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	sso := "[profile sso]\nsso_start_url = https://example.awsapps.com/start\nsso_region = us-east-1\n" +
+		"sso_account_id = 123456789012\nsso_role_name = ReadOnly\nregion = eu-west-1\n" +
+		"[profile dev]\nregion = ap-southeast-2\n"
+	if err := ioutil.WriteFile(config, []byte(sso), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"AWS_CONFIG_FILE": config, "AWS_REGION": "", "AWS_DEFAULT_REGION": ""} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+	tests := []struct {
+		profile string
+		region  string
+	}{
+		{"sso", "eu-west-1"},
+		{"dev", "ap-southeast-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			ctx := &AppContext{Profile: aws.String(tt.profile)}
+			options := ctx.SessionOptions(aws.Config{})
+			if options.SharedConfigState != session.SharedConfigEnable {
+				t.Errorf("shared config state %v, want SharedConfigEnable", options.SharedConfigState)
+			}
+			if options.Profile != tt.profile {
+				t.Errorf("profile %q, want %q", options.Profile, tt.profile)
+			}
+			sess, err := session.NewSessionWithOptions(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if region := aws.StringValue(sess.Config.Region); region != tt.region {
+				t.Errorf("region %q, want %q from the profile", region, tt.region)
+			}
+		})
+	}
+}
+
+// gatedSource holds each listing open until limit listings are in flight,
+// or a second has passed, and then for a little longer, recording the most
+// listings in flight at once
+type gatedSource struct {
+	memSource
+	limit    int
+	mu       sync.Mutex
+	inflight int
+	max      int
+	full     chan struct{}
+}
+
+func (gs *gatedSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	gs.mu.Lock()
+	gs.inflight++
+	if gs.inflight > gs.max {
+		gs.max = gs.inflight
+		if gs.max == gs.limit {
+			close(gs.full)
+		}
+	}
+	gs.mu.Unlock()
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		select {
+		case <-gs.full:
+		case <-time.After(time.Second):
+		}
+		time.Sleep(20 * time.Millisecond)
+		for obj := range gs.memSource.List(ctx, prefix) {
+			sendObject(ctx, objects, obj)
+		}
+		gs.mu.Lock()
+		gs.inflight--
+		gs.mu.Unlock()
+	}()
+	return objects
+}
+
+func TestParallelBuckets(t *testing.T) {
+	for _, limit := range []int{1, 2, 3, 6} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			source := &gatedSource{memSource: memSource{"a.log": "hit\n"}, limit: limit, full: make(chan struct{})}
+			mj, _ := newTestJob(source, "hit")
+			mj.Context.Bucket = aws.String("b1,b2,b3,b4,b5,b6")
+			mj.ParallelBuckets = limit
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary.Objects != 6 {
+				t.Errorf("searched %d objects, want 6", summary.Objects)
+			}
+			if source.max != limit {
+				t.Errorf("%d buckets listed at once, want %d", source.max, limit)
+			}
+		})
+	}
+}
+
+// failingSource fails its first listing
+type failingSource struct {
+	memSource
+	calls int32
+}
+
+func (fs *failingSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	if atomic.AddInt32(&fs.calls, 1) > 1 {
+		return fs.memSource.List(ctx, prefix)
+	}
+	objects := make(chan ObjectInfo, 1)
+	objects <- ObjectInfo{Err: errors.New("access denied")}
+	close(objects)
+	return objects
+}
+
+func TestListingErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(mj *MatchJob) error
+		want string
+	}{
+		{"list keys", func(mj *MatchJob) error { return mj.JustListNameMatches(context.Background()) }, "b2/a.log\n"},
+		{"estimate cost", func(mj *MatchJob) error { return mj.EstimateCost(context.Background(), 0.09, 0.0004) }, ""},
+		{"benchmark", func(mj *MatchJob) error { return mj.Benchmark(context.Background(), []int{1}, 10) }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(&failingSource{memSource: memSource{"a.log": "hit\n"}}, "hit")
+			mj.Context.Bucket = aws.String("b1,b2")
+			err := tt.run(mj)
+			if err == nil || err.Error() != "1 of 2 buckets could not be listed" {
+				t.Errorf("error %v, want 1 of 2 buckets could not be listed", err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchWholeObject(t *testing.T) {
+	source := memSource{
+		"a.log": "begin\nhit\nend\n",
+		"b.log": "begin\nmiss\nend\n",
+	}
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+		want  string
+	}{
+		{"keys", func(mj *MatchJob) {}, "a.log\n"},
+		{"count", func(mj *MatchJob) { mj.Count = true }, "a.log:1\nb.log:0\n"},
+		{"list errors", func(mj *MatchJob) { mj.ListErrors = true }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(source, "begin.*hit.*end")
+			mj.SetWholeObject(1 << 20)
+			tt.setup(mj)
+			if _, err := mj.Search(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// encodedSource serves every object with a gzip Content-Encoding, as S3 does
+// for objects uploaded with one
+type encodedSource struct {
+	memSource
+}
+
+// Get implements ObjectSource
+func (es encodedSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := es.memSource.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &objectBody{ReadCloser: body, encoding: "gzip"}, nil
+}
+
+func TestSearchMaxTotalBytes(t *testing.T) {
+	hits := strings.Repeat("hit\n", 1000)
+	tests := []struct {
+		name     string
+		source   ObjectSource
+		limit    int64
+		searched []string
+	}{
+		{"within limit", memSource{"a.log": hits, "b.log": hits}, 10000, []string{"a.log", "b.log"}},
+		{"content encoding", encodedSource{memSource{"a.bz2": gzipped(t, hits, 0)}}, 10000, []string{"a.bz2"}},
+		// b.log takes the total past the limit, so the search stops there
+		{"cancelled", memSource{"a.log": hits, "b.log": hits, "c.log": hits, "d.log": hits}, 6000, []string{"a.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, _ := newTestJob(tt.source, "hit")
+			mj.MaxTotalBytes = tt.limit
+			mj.Count = true
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var searched []string
+			for key := range summary.KeyMatches {
+				searched = append(searched, key)
+			}
+			sort.Strings(searched)
+			if strings.Join(searched, ",") != strings.Join(tt.searched, ",") {
+				t.Errorf("searched %q, want %q", searched, tt.searched)
+			}
+			if got := summary.KeyMatches[tt.searched[0]]; got != 1000 {
+				t.Errorf("%s: %d matches, want 1000", tt.searched[0], got)
+			}
+			if len(summary.Errors) > 0 {
+				t.Errorf("errors %q", summary.Errors)
+			}
+			if total := atomic.LoadInt64(mj.downloaded); total > tt.limit+int64(len(hits)) {
+				t.Errorf("downloaded %d bytes, more than an object past the limit of %d", total, tt.limit)
+			}
+		})
+	}
+}
+
+func TestLiteralMatch(t *testing.T) {
+	lines := []string{"", "a.b", "axb", "(x)", "x+y", "AXB", "a.bc", "foo", "xfooy", "a foo b"}
+	for _, pattern := range []string{"a.b", `a\.b`, `\(x\)`, `x\+y`, "foo", "^foo", "^foo$", `\bfoo\b`, "foo$", "(?i)axb"} {
+		mj, _ := newTestJob(nil, pattern)
+		for _, line := range lines {
+			if got, want := mj.MatchContentString(line), mj.ContentMatch.MatchString(line); got != want {
+				t.Errorf("pattern %q line %q: substring match %v, regex match %v", pattern, line, got, want)
+			}
+		}
+	}
+	for pattern, want := range map[string]bool{"foo": true, `a\.b`: true, "a.b": false, "^foo$": false, `\bfoo\b`: false, "(?i)foo": false} {
+		if mj, _ := newTestJob(nil, pattern); mj.isLiteral != want {
+			t.Errorf("pattern %q: substring search %v, want %v", pattern, mj.isLiteral, want)
+		}
+	}
+}
+
+// benchmarkLines is the content searched by BenchmarkMatchLines
+var benchmarkLines = strings.Repeat("2024-01-01T00:00:00Z INFO request served in 12ms path=/api/v1/items status=200\n", 10000) +
+	"2024-01-01T00:00:01Z ERROR connection reset by peer\n"
+
+func BenchmarkMatchLines(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		literal bool
+	}{{"literal", true}, {"regex", false}} {
+		b.Run(bm.name, func(b *testing.B) {
+			mj, _ := newTestJob(nil, "connection reset")
+			mj.isLiteral = bm.literal
+			b.SetBytes(int64(len(benchmarkLines)))
+			for i := 0; i < b.N; i++ {
+				if _, err := mj.MatchLines(ObjectInfo{Key: "bench.log"}, strings.NewReader(benchmarkLines)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchTimeout(t *testing.T) {
+	const pattern = "(a|aa)*b"
+	content := "ab\n" + strings.Repeat(strings.Repeat("a", 60000)+"\n", 140)
+	start := time.Now()
+	regexp.MustCompile(pattern).MatchString(content[3:])
+	full := time.Since(start)
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+		want  string
+	}{
+		{"lines", func(mj *MatchJob) {}, "ab\n"},
+		{"parallel lines", func(mj *MatchJob) { mj.MatchWorkers = 4 }, "ab\n"},
+		{"multiline", func(mj *MatchJob) { mj.SetMultiline(int64(len(content))) }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(memSource{"a.log": content}, pattern)
+			mj.MatchTimeout = full / 20
+			tt.setup(mj)
+			start := time.Now()
+			summary, err := mj.Search(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > full/2 {
+				t.Errorf("searched for %v with a timeout of %v, when matching everything takes %v", elapsed, mj.MatchTimeout, full)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			if len(summary.Errors) != 1 || !strings.HasSuffix(summary.Errors[0], ErrMatchTimeout.Error()) {
+				t.Errorf("errors %q, want a match timeout", summary.Errors)
+			}
+		})
+	}
+}
+
+func TestSearchSpans(t *testing.T) {
+	source := memSource{"a.log": "miss\n\tone hit, then another hit\xff\nhit\n"}
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+		want  [][][]int
+	}{
+		{"lines", func(mj *MatchJob) {}, [][][]int{{{5, 8}, {23, 26}}, {{0, 3}}}},
+		{"multiline", func(mj *MatchJob) { mj.SetMultiline(1 << 20) }, [][][]int{{{0, 3}}, {{0, 3}}, {{0, 3}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mj, output := newTestJob(source, "hit")
+			mj.OutputFormat = outputNDJSON
+			mj.IncludeSpans = true
+			tt.setup(mj)
+			if _, err := mj.Search(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var spans [][][]int
+			scanner := bufio.NewScanner(output)
+			for scanner.Scan() {
+				var record Record
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					t.Fatal(err)
+				}
+				spans = append(spans, record.Spans)
+			}
+			if !reflect.DeepEqual(spans, tt.want) {
+				t.Errorf("spans %v, want %v", spans, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "sort"
+
+// sequencedObject is a listed object numbered in listing order, with seq
+// counting only the objects queued to be searched and position counting
+// every object listed
+type sequencedObject struct {
+	obj      ObjectInfo
+	seq      int
+	position int64
+}
+
+// ReorderBuffer writes the held output of results in sequence order as each
+// becomes the next due, holding back those which finish early
+type ReorderBuffer struct {
+	Output  *Output
+	next    int
+	pending map[int]ObjectResult
+}
+
+// NewReorderBuffer creates a ReorderBuffer writing to output
+func NewReorderBuffer(output *Output) *ReorderBuffer {
+	return &ReorderBuffer{Output: output, pending: map[int]ObjectResult{}}
+}
+
+// Add holds a result, then writes the output of every result now due
+func (rb *ReorderBuffer) Add(result ObjectResult) {
+	rb.pending[result.seq] = result
+	for {
+		due, ok := rb.pending[rb.next]
+		if !ok {
+			return
+		}
+		delete(rb.pending, rb.next)
+		rb.next++
+		if len(due.held) > 0 {
+			rb.Output.WriteGroup(due.header, due.held)
+		}
+	}
+}
+
+// Flush writes the output of any results still held, in sequence order.
+// These follow gaps left by objects dropped on cancellation
+func (rb *ReorderBuffer) Flush() {
+	seqs := make([]int, 0, len(rb.pending))
+	for seq := range rb.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		if due := rb.pending[seq]; len(due.held) > 0 {
+			rb.Output.WriteGroup(due.header, due.held)
+		}
+		delete(rb.pending, seq)
+	}
+}
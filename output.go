@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Output formats accepted by -output
+const (
+	outputText   = "text"
+	outputNDJSON = "ndjson"
+	outputESBulk = "es-bulk"
+)
+
+// Record is a single result in structured output. Matches carry Match, the
+// first lines of a matching object carry Peek, and -count totals carry
+// Count, as do -histogram intervals along with Time; records naming only an
+// object are matching keys
+type Record struct {
+	Bucket       string            `json:"bucket,omitempty"`
+	Key          string            `json:"key,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	Group        string            `json:"group,omitempty"`
+	Time         string            `json:"time,omitempty"`
+	Match        string            `json:"match,omitempty"`
+	Peek         string            `json:"peek,omitempty"`
+	Count        *int              `json:"count,omitempty"`
+	Keys         []string          `json:"keys,omitempty"`
+	Spans        [][]int           `json:"spans,omitempty"`
+	LineStats    *LineLengthReport `json:"line_stats,omitempty"`
+}
+
+// ObjectRecord returns a Record describing a listed object
+func ObjectRecord(bucket string, obj ObjectInfo) Record {
+	return Record{
+		Bucket:       bucket,
+		Key:          obj.Key,
+		Size:         obj.Size,
+		StorageClass: obj.StorageClass,
+		LastModified: obj.LastModified.UTC().Format(time.RFC3339),
+	}
+}
+
+// JSON encodes the record as a single line of JSON
+func (r Record) JSON() string {
+	encoded, _ := json.Marshal(r)
+	return string(encoded)
+}
+
+// SafeText escapes control characters in text read from objects as \xNN,
+// so that raw escape sequences cannot alter the terminal it is printed to.
+// Tabs and newlines are kept, as are bytes which are not valid UTF-8
+func SafeText(text string) string {
+	if strings.IndexFunc(text, unsafeRune) < 0 {
+		return text
+	}
+	var safe strings.Builder
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		if unsafeRune(r) {
+			fmt.Fprintf(&safe, "\\x%02x", r)
+		} else {
+			safe.WriteString(text[:size])
+		}
+		text = text[size:]
+	}
+	return safe.String()
+}
+
+// unsafeRune reports whether SafeText escapes a rune
+func unsafeRune(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n'
+}
+
+// ESBulkAction returns the Elasticsearch bulk API action line indexing the
+// document which follows it into index, or into the index named in the
+// _bulk URL if index is empty
+func ESBulkAction(index string) string {
+	target := map[string]string{}
+	if index != "" {
+		target["_index"] = index
+	}
+	encoded, _ := json.Marshal(map[string]map[string]string{"index": target})
+	return string(encoded)
+}
+
+// Output serialises match output from concurrent workers through a single
+// buffered writer. With LineFlush set, each line is flushed as soon as it
+// is written, so that streamed results can be followed live. RecordPrefix,
+// if set, is written on a line of its own before each record, as for an
+// ESBulkAction
+type Output struct {
+	mu           sync.Mutex
+	writer       *bufio.Writer
+	closers      []io.Closer
+	LineFlush    bool
+	RecordPrefix string
+}
+
+// NewOutput creates an Output writing to w with a buffer of the given size
+func NewOutput(w io.Writer, size int) *Output {
+	return &Output{writer: bufio.NewWriterSize(w, size)}
+}
+
+// CreateOutputFile creates an Output writing to a file, which is compressed
+// with gzip if its name ends in .gz. With appending set, output is added to
+// the end of an existing file rather than replacing it; a compressed file
+// gains another gzip member, which gzip readers treat as a continuation
+func CreateOutputFile(filename string, size int, appending bool) (*Output, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(filename, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if path.Ext(filename) != ".gz" {
+		output := NewOutput(file, size)
+		output.closers = []io.Closer{file}
+		return output, nil
+	}
+	compressor := gzip.NewWriter(file)
+	output := NewOutput(compressor, size)
+	output.closers = []io.Closer{compressor, file}
+	return output, nil
+}
+
+// Printf formats and writes a message to the output buffer
+func (o *Output) Printf(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.RecordPrefix != "" {
+		fmt.Fprintln(o.writer, o.RecordPrefix)
+	}
+	fmt.Fprintf(o.writer, format, args...)
+	if o.LineFlush {
+		o.writer.Flush()
+	}
+}
+
+// WriteGroup writes a header line followed by a block of output as a unit,
+// so that it is not interleaved with output from other workers. An empty
+// header writes the block alone
+func (o *Output) WriteGroup(header string, block []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if header != "" {
+		fmt.Fprintln(o.writer, header)
+	}
+	o.writer.Write(block)
+	if o.LineFlush {
+		o.writer.Flush()
+	}
+}
+
+// Flush writes any buffered output to the underlying writer
+func (o *Output) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.writer.Flush()
+}
+
+// Close flushes the output and closes any underlying file
+func (o *Output) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.writer.Flush()
+	for _, closer := range o.closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	o.closers = nil
+	return err
+}
+
+// FlushEvery flushes the output at the given interval, so that results
+// trickle out during long searches. It never returns
+func (o *Output) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		o.Flush()
+	}
+}
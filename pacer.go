@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Bounds on the interval a Pacer leaves between requests once throttled
+const (
+	minPacerInterval = 10 * time.Millisecond
+	maxPacerInterval = 5 * time.Second
+)
+
+// Pacer spaces out requests adaptively. Each throttling response, such as
+// S3's 503 SlowDown, doubles the interval between requests up to
+// maxPacerInterval, and each other response shrinks it by a tenth, so that
+// the request rate recovers gradually once the store stops pushing back.
+// Requests are not delayed at all until the first throttling response
+type Pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Wait blocks until the next request may be made, or ctx is cancelled
+func (p *Pacer) Wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	start := p.next
+	if start.Before(now) {
+		start = now
+	}
+	p.next = start.Add(p.interval)
+	p.mu.Unlock()
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Throttled slows the request rate after a throttling response
+func (p *Pacer) Throttled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval *= 2
+	if p.interval < minPacerInterval {
+		p.interval = minPacerInterval
+	}
+	if p.interval > maxPacerInterval {
+		p.interval = maxPacerInterval
+	}
+}
+
+// Succeeded speeds the request rate back up after any other response
+func (p *Pacer) Succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval -= p.interval / 10
+	if p.interval < minPacerInterval {
+		p.interval = 0
+	}
+}
+
+// Observe adjusts the request rate according to a response status
+func (p *Pacer) Observe(status int) {
+	switch status {
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		p.Throttled()
+	default:
+		p.Succeeded()
+	}
+}
+
+// AddHandlers paces every request sent by clients of an AWS session,
+// including the SDK's own retries, so that listing and fetching share one
+// rate. Pacing is done in handlers rather than in the HTTP transport so
+// that the SDK can still configure the transport, such as for a CA bundle
+func (p *Pacer) AddHandlers(handlers *request.Handlers) {
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "s3multigrep.PacerWait",
+		Fn: func(r *request.Request) {
+			// a cancelled context fails the send which follows
+			p.Wait(r.Context())
+		},
+	})
+	handlers.Send.PushBackNamed(request.NamedHandler{
+		Name: "s3multigrep.PacerObserve",
+		Fn: func(r *request.Request) {
+			if r.HTTPResponse != nil {
+				p.Observe(r.HTTPResponse.StatusCode)
+			}
+		},
+	})
+}
+
+// Interval returns the current interval between requests
+func (p *Pacer) Interval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interval
+}
+
+// pacingTransport paces every request made through Transport, for object
+// stores which are not reached through the AWS SDK
+type pacingTransport struct {
+	Transport http.RoundTripper
+	Pacer     *Pacer
+}
+
+// RoundTrip implements http.RoundTripper
+func (pt *pacingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := pt.Pacer.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := pt.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	pt.Pacer.Observe(resp.StatusCode)
+	return resp, nil
+}
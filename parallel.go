@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"sync"
+)
+
+// parallelChunkSize is roughly how much of an object each MatchWorkers
+// goroutine matches at a time. Chunks are extended to the end of a line
+const parallelChunkSize = 1 << 20
+
+// lineChunk is a run of whole lines from an object, numbered from first,
+// whose data is charged to the buffer budget until printed. Once matched,
+// its matching lines are delivered on done
+type lineChunk struct {
+	data  []byte
+	first int64
+	err   error
+	done  chan []chunkMatch
+}
+
+// chunkMatch is a matching line of a chunk and the text to print for it
+type chunkMatch struct {
+	number int64
+	text   string
+}
+
+// lines splits a chunk into lines the way bufio.ScanLines does, calling fn
+// with each line and its number until fn returns false
+func (lc *lineChunk) lines(fn func(number int64, line []byte) bool) {
+	data, number := lc.data, lc.first
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if !fn(number, line) {
+			return
+		}
+		number++
+	}
+}
+
+// matchLinesParallel is MatchLines for newline-delimited objects, splitting
+// the stream into chunks of whole lines which MatchWorkers goroutines match
+// concurrently. Matches are printed, and line lengths counted, in object
+// order, so the output and LineStats are the same as matching line by line,
+// including stopping with bufio.ErrTooLong at the first line too long for
+// bufio.Scanner. A chunk which would exceed the buffer budget stops the
+// object with ErrBufferBudget, after the matches of earlier chunks. Workers
+// still matching when printing stops are waited for, as they update
+// Duplicates and Histogram
+func (mj *MatchJob) matchLinesParallel(obj ObjectInfo, reader io.Reader) (int, error) {
+	stop := make(chan struct{})
+	work := make(chan *lineChunk)
+	ordered := make(chan *lineChunk, mj.MatchWorkers)
+	go mj.splitChunks(reader, work, ordered, stop)
+	var workers sync.WaitGroup
+	for i := 0; i < mj.MatchWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for chunk := range work {
+				chunk.done <- mj.matchChunk(obj, chunk)
+			}
+		}()
+	}
+	lengths := mj.LineStats.Tally()
+	defer mj.LineStats.Merge(lengths)
+	headLimit := int64(mj.Peek)
+	if mj.LineEnd > 0 && mj.LineEnd+1 < headLimit {
+		headLimit = mj.LineEnd + 1
+	}
+	matches := 0
+	var head []string
+	var err error
+	for chunk := range ordered {
+		matched := <-chunk.done
+		stopped := false
+		last := int64(math.MaxInt64)
+		for _, match := range matched {
+			if !mj.PrintMatch(obj, match.text) {
+				stopped, last = true, match.number
+				break
+			}
+			matches++
+		}
+		chunk.lines(func(number int64, line []byte) bool {
+			if len(line) >= bufio.MaxScanTokenSize {
+				return false
+			}
+			if number > last {
+				return false
+			}
+			if int64(len(head)) < headLimit {
+				head = append(head, string(line))
+			}
+			if mj.LineEnd > 0 && number > mj.LineEnd {
+				return false
+			}
+			lengths.Add(len(line))
+			return true
+		})
+		mj.Buffers.Release(int64(len(chunk.data)))
+		if stopped || chunk.err != nil {
+			err = chunk.err
+			break
+		}
+	}
+	close(stop)
+	workers.Wait()
+	for chunk := range ordered {
+		mj.Buffers.Release(int64(len(chunk.data)))
+	}
+	if matches > 0 {
+		mj.PrintPeek(obj, head)
+	}
+	return matches, err
+}
+
+// splitChunks reads whole-line chunks from reader, sending each to work to
+// be matched and to ordered to be printed, until the stream ends, a chunk
+// is past LineEnd or would exceed the buffer budget, or stop is closed
+func (mj *MatchJob) splitChunks(reader io.Reader, work, ordered chan<- *lineChunk, stop <-chan struct{}) {
+	defer close(ordered)
+	defer close(work)
+	buffered := bufio.NewReaderSize(reader, parallelChunkSize)
+	first := int64(1)
+	for {
+		data := make([]byte, parallelChunkSize)
+		n, err := io.ReadFull(buffered, data)
+		data = data[:n]
+		if err == nil {
+			var rest []byte
+			rest, err = buffered.ReadBytes('\n')
+			data = append(data, rest...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			if len(data) == 0 {
+				return
+			}
+		}
+		if !mj.Buffers.Reserve(int64(len(data))) {
+			data, err = nil, ErrBufferBudget
+		}
+		chunk := &lineChunk{data: data, first: first, err: err, done: make(chan []chunkMatch, 1)}
+		last := err != nil || len(data) < parallelChunkSize || data[len(data)-1] != '\n'
+		select {
+		case ordered <- chunk:
+		case <-stop:
+			mj.Buffers.Release(int64(len(data)))
+			return
+		}
+		select {
+		case work <- chunk:
+		case <-stop:
+			return
+		}
+		first += int64(bytes.Count(data, []byte("\n")))
+		if last || (mj.LineEnd > 0 && first > mj.LineEnd) {
+			return
+		}
+	}
+}
+
+// matchChunk returns the matching lines in a chunk between LineStart and
+// LineEnd. A line too long for bufio.Scanner ends the chunk with
+// bufio.ErrTooLong, as it would end a serial scan, and the object timing
+// out ends it with ErrMatchTimeout
+func (mj *MatchJob) matchChunk(obj ObjectInfo, chunk *lineChunk) []chunkMatch {
+	var matched []chunkMatch
+	chunk.lines(func(number int64, line []byte) bool {
+		if obj.timedOut() {
+			chunk.err = ErrMatchTimeout
+			return false
+		}
+		if len(line) >= bufio.MaxScanTokenSize {
+			chunk.err = bufio.ErrTooLong
+			return false
+		}
+		if mj.LineEnd > 0 && number > mj.LineEnd {
+			return false
+		}
+		if number < mj.LineStart {
+			return true
+		}
+		if text, ok := mj.matchLine(obj, string(line)); ok {
+			matched = append(matched, chunkMatch{number: number, text: text})
+		}
+		return true
+	})
+	return matched
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parallelObject returns an object of several chunks of lines of varying
+// lengths, with a matching line straddling the first chunk boundary and
+// another ending exactly on the second, where the first chunk has been
+// extended to the end of the straddling line
+func parallelObject() string {
+	var builder strings.Builder
+	for i := 0; builder.Len() < parallelChunkSize-200; i++ {
+		fmt.Fprintf(&builder, "line %d %s%s\n", i, strings.Repeat("x", i%97), map[bool]string{true: " hit"}[i%13 == 0])
+	}
+	builder.WriteString(strings.Repeat("w", parallelChunkSize-10-builder.Len()))
+	builder.WriteString(" straddling the boundary hit\n")
+	const boundary = "ends on the boundary hit\n"
+	end := builder.Len() + parallelChunkSize
+	for builder.Len() < end-len(boundary)-100 {
+		builder.WriteString("filler\n")
+	}
+	builder.WriteString(strings.Repeat("y", end-len(boundary)-builder.Len()-1) + "\n")
+	builder.WriteString(boundary)
+	for i := 0; builder.Len() < 5*parallelChunkSize+1234; i++ {
+		fmt.Fprintf(&builder, "more %d %s%s\r\n", i, strings.Repeat("z", i%211), map[bool]string{true: " hit"}[i%7 == 0])
+	}
+	builder.WriteString("last hit without a newline")
+	return builder.String()
+}
+
+func TestMatchLinesParallel(t *testing.T) {
+	source := memSource{"big.log": parallelObject()}
+	tests := []struct {
+		name  string
+		setup func(mj *MatchJob)
+	}{
+		{"all lines", func(mj *MatchJob) {}},
+		{"line range", func(mj *MatchJob) { mj.LineStart, mj.LineEnd = 5000, 60000 }},
+		{"peek", func(mj *MatchJob) { mj.Peek = 3 }},
+		{"max lines", func(mj *MatchJob) { mj.MaxLines = 2000 }},
+		{"max lines in the first chunk", func(mj *MatchJob) { mj.MaxLines, mj.Peek = 2, 40 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var outputs []string
+			var stats []LineLengthReport
+			for _, workers := range []int{1, 4} {
+				mj, output := newTestJob(source, "hit")
+				mj.MatchWorkers = workers
+				mj.LineStats = NewLineStats()
+				mj.Duplicates = NewLineKeys()
+				tt.setup(mj)
+				if _, err := mj.Search(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, output.String())
+				stats = append(stats, mj.LineStats.Report())
+			}
+			if outputs[0] != outputs[1] {
+				t.Errorf("parallel output of %d bytes differs from the %d bytes matched serially", len(outputs[1]), len(outputs[0]))
+			}
+			for _, line := range []string{" straddling the boundary hit\n", "\nends on the boundary hit\n", "\nlast hit without a newline\n"} {
+				if tt.name == "all lines" && !strings.Contains(outputs[1], line) {
+					t.Errorf("%q not matched", line)
+				}
+			}
+			if !reflect.DeepEqual(stats[0], stats[1]) {
+				t.Errorf("parallel line stats %+v, want %+v", stats[1], stats[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// partitionPlaceholders are the placeholders of a -partition-format, each
+// followed by the time layout of the value replacing it
+var partitionPlaceholders = []string{
+	"{yyyy}", "2006",
+	"{MM}", "01",
+	"{dd}", "02",
+	"{HH}", "15",
+}
+
+// maxPartitions bounds the number of prefixes a date range may expand to
+const maxPartitions = 100000
+
+// ParseDateRange parses a -date-range of the form START:END, where both are
+// dates such as 2024-01-31. The range includes the whole of END
+func ParseDateRange(value string) (time.Time, time.Time, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date range %q, expected START:END such as 2024-01-01:2024-01-07", value)
+	}
+	start, err := time.Parse("2006-01-02", fields[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start date %q", fields[0])
+	}
+	end, err := time.Parse("2006-01-02", fields[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end date %q", fields[1])
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("date range %q ends before it starts", value)
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
+
+// PartitionPrefixes expands a partition format such as
+// logs/{yyyy}/{MM}/{dd}/ into a prefix for each partition from start up to,
+// but not including, end. Formats with {HH} have a partition per hour, and
+// others one per day, with repeats removed for formats without {dd}
+func PartitionPrefixes(format string, start, end time.Time) ([]string, error) {
+	if partitionPrefix(format, start) == format {
+		return nil, fmt.Errorf("partition format %q has none of {yyyy}, {MM}, {dd} and {HH}", format)
+	}
+	step := 24 * time.Hour
+	if strings.Contains(format, "{HH}") {
+		step = time.Hour
+	}
+	var prefixes []string
+	for partition := start; partition.Before(end); partition = partition.Add(step) {
+		prefix := partitionPrefix(format, partition)
+		if len(prefixes) > 0 && prefixes[len(prefixes)-1] == prefix {
+			continue
+		}
+		if len(prefixes) == maxPartitions {
+			return nil, errors.New("date range expands to too many partitions")
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// partitionPrefix fills in the placeholders of format for a partition
+func partitionPrefix(format string, partition time.Time) string {
+	pairs := make([]string, len(partitionPlaceholders))
+	for i := 0; i < len(pairs); i += 2 {
+		pairs[i], pairs[i+1] = partitionPlaceholders[i], partition.Format(partitionPlaceholders[i+1])
+	}
+	return strings.NewReplacer(pairs...).Replace(format)
+}
+
+// AddPartitions adds a prefix for each partition of format in dateRange
+func (pl *PrefixList) AddPartitions(format, dateRange string) error {
+	start, end, err := ParseDateRange(dateRange)
+	if err != nil {
+		return err
+	}
+	prefixes, err := PartitionPrefixes(format, start, end)
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, prefixes...)
+	return nil
+}
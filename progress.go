@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusRedrawInterval limits how often the terminal status line is redrawn
+const statusRedrawInterval = 100 * time.Millisecond
+
+// progressBarWidth is the number of cells in the progress bar
+const progressBarWidth = 30
+
+// Progress reports per-object progress. On a terminal it maintains a single
+// status line which is redrawn in place; otherwise every object is logged on
+// a line of its own. With Bar set, the status line shows the share of listed
+// bytes searched so far. As listing runs ahead of searching, this is an
+// estimate, marked with ~, until every listing is complete
+type Progress struct {
+	Bar      bool
+	mu       sync.Mutex
+	writer   io.Writer
+	tty      bool
+	objects  int
+	matches  int
+	drawn    bool
+	last     time.Time
+	pending  int
+	listed   int
+	total    int64
+	finished int
+	done     int64
+}
+
+// NewProgress creates a Progress writing to w, redrawing a status line in
+// place if tty is set
+func NewProgress(w io.Writer, tty bool) *Progress {
+	return &Progress{writer: w, tty: tty}
+}
+
+// IsTerminal reports whether a file is a character device such as a
+// terminal, as opposed to a pipe or regular file
+func IsTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Object records that an object has been searched
+func (p *Progress) Object(key string, matches int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.objects++
+	p.matches += matches
+	if !p.tty {
+		fmt.Fprintf(p.writer, "%s: %d matches\n", key, matches)
+		return
+	}
+	if time.Since(p.last) >= statusRedrawInterval {
+		p.draw()
+	}
+}
+
+// Listings records that n listings are about to start, so that totals are
+// known once each has called ListingDone
+func (p *Progress) Listings(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending += n
+}
+
+// ListingDone records that a listing is complete
+func (p *Progress) ListingDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending--
+}
+
+// Listed records that an object of the given size is to be searched
+func (p *Progress) Listed(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listed++
+	p.total += size
+}
+
+// Finished records that a listed object of the given size has been dealt
+// with, whether it was searched, skipped or failed
+func (p *Progress) Finished(size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished++
+	p.done += size
+}
+
+// Counts returns the number of objects searched and matches found so far
+func (p *Progress) Counts() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.objects, p.matches
+}
+
+// Logf writes a message on a line of its own, above the status line
+func (p *Progress) Logf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintf(p.writer, format, args...)
+	if p.drawn {
+		p.draw()
+	}
+}
+
+// Done removes the status line, leaving the terminal ready for final output
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	p.drawn = false
+}
+
+// Writer wraps w so that anything written to it appears above the status
+// line rather than being mixed into it
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if !p.tty {
+		return w
+	}
+	return &progressWriter{progress: p, writer: w}
+}
+
+// draw rewrites the status line. The caller must hold the lock
+func (p *Progress) draw() {
+	if !p.tty {
+		return
+	}
+	if p.Bar && p.listed > 0 {
+		fmt.Fprintf(p.writer, "\r\033[K%s %d/%d objects, %d matches", p.bar(), p.finished, p.listed, p.matches)
+	} else {
+		fmt.Fprintf(p.writer, "\r\033[Ksearched %d objects, %d matches", p.objects, p.matches)
+	}
+	p.drawn = true
+	p.last = time.Now()
+}
+
+// bar renders the progress bar and percentage, by bytes unless every listed
+// object is empty. The caller must hold the lock
+func (p *Progress) bar() string {
+	fraction := float64(p.finished) / float64(p.listed)
+	if p.total > 0 {
+		fraction = float64(p.done) / float64(p.total)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+	estimate := ""
+	if p.pending > 0 {
+		estimate = "~"
+	}
+	return fmt.Sprintf("[%s%s] %s%3.0f%%", strings.Repeat("#", filled), strings.Repeat(" ", progressBarWidth-filled), estimate, fraction*100)
+}
+
+// clear erases the status line if one is shown. The caller must hold the
+// lock
+func (p *Progress) clear() {
+	if p.tty && p.drawn {
+		fmt.Fprint(p.writer, "\r\033[K")
+	}
+}
+
+// progressWriter interleaves writes with a Progress status line. Partial
+// lines are held back until complete, so the status line never splits one
+type progressWriter struct {
+	progress *Progress
+	writer   io.Writer
+	pending  []byte
+}
+
+// Write implements io.Writer
+func (pw *progressWriter) Write(data []byte) (int, error) {
+	pw.progress.mu.Lock()
+	defer pw.progress.mu.Unlock()
+	pw.pending = append(pw.pending, data...)
+	end := bytes.LastIndexByte(pw.pending, '\n') + 1
+	if end == 0 {
+		return len(data), nil
+	}
+	pw.progress.clear()
+	_, err := pw.writer.Write(pw.pending[:end])
+	pw.pending = append(pw.pending[:0], pw.pending[end:]...)
+	if pw.progress.drawn {
+		pw.progress.draw()
+	}
+	return len(data), err
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// Sampled reports whether a key falls within the job's random sample. The
+// decision depends only on the key and SampleSeed, so a given seed always
+// selects the same subset of a bucket
+func (mj *MatchJob) Sampled(key string) bool {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatInt(mj.SampleSeed, 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return float64(hash.Sum64())/math.MaxUint64 < mj.SampleRate
+}
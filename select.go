@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// SelectInputSerialization describes an object to S3 Select based on its
+// key, returning nil if the object is not in a format S3 Select can query.
+// Parquet objects, which compress their own columns, must be stored as is
+func SelectInputSerialization(key string) *s3.InputSerialization {
+	input := &s3.InputSerialization{CompressionType: aws.String(s3.CompressionTypeNone)}
+	if path.Ext(key) == ".parquet" {
+		input.Parquet = &s3.ParquetInput{}
+		return input
+	}
+	switch path.Ext(key) {
+	case ".gz":
+		input.CompressionType = aws.String(s3.CompressionTypeGzip)
+		key = strings.TrimSuffix(key, ".gz")
+	case ".bz2":
+		input.CompressionType = aws.String(s3.CompressionTypeBzip2)
+		key = strings.TrimSuffix(key, ".bz2")
+	}
+	switch path.Ext(key) {
+	case ".csv":
+		input.CSV = &s3.CSVInput{FileHeaderInfo: aws.String(s3.FileHeaderInfoUse)}
+	case ".json", ".jsonl", ".ndjson":
+		input.JSON = &s3.JSONInput{Type: aws.String(s3.JSONTypeLines)}
+	default:
+		return nil
+	}
+	return input
+}
+
+// SelectObject runs the select expression against an object, returning a
+// reader over the records streamed back by S3. CSV records are returned as
+// CSV, and JSON and Parquet records as JSON lines
+func (mj *MatchJob) SelectObject(ctx context.Context, key string, input *s3.InputSerialization) (io.ReadCloser, error) {
+	output := &s3.OutputSerialization{}
+	if input.CSV != nil {
+		output.CSV = &s3.CSVOutput{}
+	} else {
+		output.JSON = &s3.JSONOutput{}
+	}
+	resp, err := mj.Context.S3.SelectObjectContentWithContext(ctx, &s3.SelectObjectContentInput{
+		Bucket:              aws.String(*mj.Context.Bucket),
+		Key:                 aws.String(key),
+		Expression:          aws.String(mj.SelectExpression),
+		ExpressionType:      aws.String(s3.ExpressionTypeSql),
+		InputSerialization:  input,
+		OutputSerialization: output,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer resp.EventStream.Close()
+		for event := range resp.EventStream.Events() {
+			if records, ok := event.(*s3.RecordsEvent); ok {
+				if _, err := writer.Write(records.Payload); err != nil {
+					return
+				}
+			}
+		}
+		writer.CloseWithError(resp.EventStream.Err())
+	}()
+	return reader, nil
+}
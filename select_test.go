@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// stubSelectStream replays a fixed sequence of S3 Select events
+type stubSelectStream struct {
+	events chan s3.SelectObjectContentEventStreamEvent
+}
+
+// newStubSelectStream creates a stream delivering a records event for each
+// payload, followed by the stats and end events S3 sends
+func newStubSelectStream(payloads ...string) *stubSelectStream {
+	events := make(chan s3.SelectObjectContentEventStreamEvent, len(payloads)+2)
+	for _, payload := range payloads {
+		events <- &s3.RecordsEvent{Payload: []byte(payload)}
+	}
+	events <- &s3.StatsEvent{Details: &s3.Stats{}}
+	events <- &s3.EndEvent{}
+	close(events)
+	return &stubSelectStream{events: events}
+}
+
+func (ss *stubSelectStream) Events() <-chan s3.SelectObjectContentEventStreamEvent {
+	return ss.events
+}
+
+func (ss *stubSelectStream) Close() error {
+	return nil
+}
+
+func (ss *stubSelectStream) Err() error {
+	return nil
+}
+
+// stubSelectS3 answers SelectObjectContent with a stubbed event stream,
+// recording the request made
+type stubSelectS3 struct {
+	s3iface.S3API
+	payloads []string
+	input    *s3.SelectObjectContentInput
+}
+
+func (ss *stubSelectS3) SelectObjectContentWithContext(ctx aws.Context, input *s3.SelectObjectContentInput, opts ...request.Option) (*s3.SelectObjectContentOutput, error) {
+	ss.input = input
+	stream := s3.NewSelectObjectContentEventStream(func(es *s3.SelectObjectContentEventStream) {
+		es.Reader = newStubSelectStream(ss.payloads...)
+		es.StreamCloser = ioutil.NopCloser(strings.NewReader(""))
+	})
+	return &s3.SelectObjectContentOutput{EventStream: stream}, nil
+}
+
+func TestSelectInputSerialization(t *testing.T) {
+	tests := []struct {
+		key         string
+		format      string
+		compression string
+	}{
+		{"a.csv", "csv", s3.CompressionTypeNone},
+		{"a.csv.gz", "csv", s3.CompressionTypeGzip},
+		{"a.json.bz2", "json", s3.CompressionTypeBzip2},
+		{"a.ndjson", "json", s3.CompressionTypeNone},
+		{"a.parquet", "parquet", s3.CompressionTypeNone},
+		{"a.parquet.gz", "", ""},
+		{"a.log", "", ""},
+		{"a.gz", "", ""},
+	}
+	for _, tt := range tests {
+		input := SelectInputSerialization(tt.key)
+		format := ""
+		switch {
+		case input == nil:
+		case input.CSV != nil:
+			format = "csv"
+		case input.JSON != nil:
+			format = "json"
+		case input.Parquet != nil:
+			format = "parquet"
+		}
+		if format != tt.format {
+			t.Errorf("%s: format %q, want %q", tt.key, format, tt.format)
+		}
+		if input != nil && aws.StringValue(input.CompressionType) != tt.compression {
+			t.Errorf("%s: compression %s, want %s", tt.key, aws.StringValue(input.CompressionType), tt.compression)
+		}
+	}
+}
+
+func TestSearchSelect(t *testing.T) {
+	tests := []struct {
+		key      string
+		payloads []string
+		want     string
+		csv      bool
+	}{
+		{"a.csv", []string{"1,hit\n2,hi", "t again\n"}, "1,hit\n2,hit again\n", true},
+		{"a.json.gz", []string{`{"msg":"hit"}` + "\n", `{"msg":"miss"}` + "\n"}, `{"msg":"hit"}` + "\n", false},
+		{"a.parquet", []string{`{"msg":"parquet hit"}` + "\n"}, `{"msg":"parquet hit"}` + "\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			stub := &stubSelectS3{payloads: tt.payloads}
+			mj, output := newTestJob(nil, "hit")
+			mj.Context.S3 = stub
+			mj.SelectExpression = "SELECT * FROM s3object s"
+			if _, err := mj.SearchObject(context.Background(), ObjectInfo{Key: tt.key}); err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			if got := aws.StringValue(stub.input.Expression); got != mj.SelectExpression {
+				t.Errorf("expression %q, want %q", got, mj.SelectExpression)
+			}
+			if csv := stub.input.OutputSerialization.CSV != nil; csv != tt.csv {
+				t.Errorf("CSV output %v, want %v", csv, tt.csv)
+			}
+		})
+	}
+}
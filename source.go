@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ObjectInfo describes a listed object. A source which fails part way
+// through a listing delivers a final ObjectInfo with Err set. While the
+// object is searched, it carries the MatchTimeout deadline, if one is set
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	OwnerID      string
+	OwnerName    string
+	Err          error
+	deadline     time.Time
+}
+
+// ObjectSource lists and fetches objects. List closes its channel once the
+// listing is complete or ctx is cancelled
+type ObjectSource interface {
+	List(ctx context.Context, prefix string) <-chan ObjectInfo
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// sendObject delivers an object to a listing channel, returning false if ctx
+// is cancelled first
+func sendObject(ctx context.Context, objects chan<- ObjectInfo, obj ObjectInfo) bool {
+	select {
+	case objects <- obj:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// S3Source lists and fetches the objects of the context's bucket. Listing
+// resumes from Token if it is set, and PageDone is called once each page has
+// been delivered with the number of objects delivered so far and the token
+// for the next page. Range, an HTTP byte range
+// such as bytes=0-1023, limits the part of each object fetched
+type S3Source struct {
+	Context    *AppContext
+	FetchOwner bool
+	Token      string
+	PageDone   func(delivered int64, next *string)
+	Range      string
+}
+
+// List implements ObjectSource
+func (ss *S3Source) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		input := &s3.ListObjectsV2Input{
+			Bucket:  aws.String(*ss.Context.Bucket),
+			MaxKeys: aws.Int64(100),
+			Prefix:  aws.String(prefix),
+		}
+		if ss.FetchOwner {
+			input.FetchOwner = aws.Bool(true)
+		}
+		if ss.Token != "" {
+			input.ContinuationToken = aws.String(ss.Token)
+		}
+		var delivered int64
+		err := ss.Context.S3.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, obj := range page.Contents {
+				if !sendObject(ctx, objects, s3ObjectInfo(obj)) {
+					return false
+				}
+				delivered++
+			}
+			if ss.PageDone != nil {
+				ss.PageDone(delivered, page.NextContinuationToken)
+			}
+			return true
+		})
+		if err != nil {
+			sendObject(ctx, objects, ObjectInfo{Err: err})
+		}
+	}()
+	return objects
+}
+
+// s3ObjectInfo converts an object from an S3 listing
+func s3ObjectInfo(obj *s3.Object) ObjectInfo {
+	info := ObjectInfo{
+		Key:          aws.StringValue(obj.Key),
+		Size:         aws.Int64Value(obj.Size),
+		LastModified: aws.TimeValue(obj.LastModified),
+		ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+		StorageClass: aws.StringValue(obj.StorageClass),
+	}
+	if obj.Owner != nil {
+		info.OwnerID = aws.StringValue(obj.Owner.ID)
+		info.OwnerName = aws.StringValue(obj.Owner.DisplayName)
+	}
+	return info
+}
+
+// Get implements ObjectSource. Objects written by the S3 encryption client
+// are fetched via the decryption client, which unwraps the data key using
+// the KMS key recorded in the object metadata
+func (ss *S3Source) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(*ss.Context.Bucket),
+		Key:    aws.String(key),
+	}
+	if ss.Range != "" {
+		input.Range = aws.String(ss.Range)
+	}
+	var getter ObjectGetter = ss.Context.S3
+	if *ss.Context.ClientSideEncryption {
+		getter = ss.Context.Decrypter
+	}
+	resp, err := getter.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &objectBody{
+		ReadCloser:  resp.Body,
+		encoding:    aws.StringValue(resp.ContentEncoding),
+		contentType: aws.StringValue(resp.ContentType),
+	}, nil
+}
+
+// objectBody is an object body which remembers the Content-Encoding and
+// Content-Type it was served with
+type objectBody struct {
+	io.ReadCloser
+	encoding    string
+	contentType string
+}
+
+// ContentEncoding implements ContentEncoded
+func (ob *objectBody) ContentEncoding() string {
+	return ob.encoding
+}
+
+// ContentType implements ContentEncoded
+func (ob *objectBody) ContentType() string {
+	return ob.contentType
+}
+
+// OpenSource returns the ObjectSource for a -source URL. Only file://DIR is
+// supported
+func OpenSource(location string) (ObjectSource, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported source %q, expected file://DIR", location)
+	}
+	root := u.Host + u.Path
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("source %s is not a directory", root)
+	}
+	return &DirSource{Root: root}, nil
+}
+
+// errStopWalk ends a directory walk early without reporting an error
+var errStopWalk = errors.New("stop walking")
+
+// DirSource treats a local directory as a bucket. Keys are slash-separated
+// paths relative to Root
+type DirSource struct {
+	Root string
+}
+
+// List implements ObjectSource, walking the directory in lexical order and
+// listing regular files whose keys begin with prefix
+func (ds *DirSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		err := filepath.Walk(ds.Root, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(ds.Root, name)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			obj := ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}
+			if !sendObject(ctx, objects, obj) {
+				return errStopWalk
+			}
+			return nil
+		})
+		if err != nil && err != errStopWalk {
+			sendObject(ctx, objects, ObjectInfo{Err: err})
+		}
+	}()
+	return objects
+}
+
+// Get implements ObjectSource, opening the file for a key. Keys such as
+// ../secret, whose path leads outside Root, are refused
+func (ds *DirSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name := filepath.Join(ds.Root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(ds.Root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("key %q is outside %s", key, ds.Root)
+	}
+	return os.Open(name)
+}
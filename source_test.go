@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// memSource is an in-memory ObjectSource holding objects by key
+type memSource map[string]string
+
+// List implements ObjectSource, listing keys with prefix in lexical order
+func (ms memSource) List(ctx context.Context, prefix string) <-chan ObjectInfo {
+	var keys []string
+	for key := range ms {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	objects := make(chan ObjectInfo)
+	go func() {
+		defer close(objects)
+		for _, key := range keys {
+			if !sendObject(ctx, objects, ObjectInfo{Key: key, Size: int64(len(ms[key]))}) {
+				return
+			}
+		}
+	}()
+	return objects
+}
+
+// Get implements ObjectSource
+func (ms memSource) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, ok := ms[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", key)
+	}
+	return ioutil.NopCloser(strings.NewReader(body)), nil
+}
+
+// s3Page is a page of a fake ListObjectsV2 listing
+type s3Page struct {
+	keys []string
+	next string
+}
+
+// fakeS3 serves a bucket as pages of a ListObjectsV2 listing, with each page
+// but the first requested by the token of the page before it. Every object
+// holds its own key as content
+func fakeS3(t *testing.T, pages map[string]s3Page) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") != "2" {
+			fmt.Fprintln(w, strings.TrimPrefix(r.URL.Path, "/bucket/"))
+			return
+		}
+		page, ok := pages[r.URL.Query().Get("continuation-token")]
+		if !ok {
+			t.Errorf("unexpected continuation token %q", r.URL.Query().Get("continuation-token"))
+			http.Error(w, "bad token", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		if page.next != "" {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", page.next)
+		}
+		for _, key := range page.keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(key)+1)
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	}))
+}
+
+// fakeS3Client returns an S3 client making anonymous requests to a fake
+// S3 server
+func fakeS3Client(server *httptest.Server) *s3.S3 {
+	return s3.New(session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.AnonymousCredentials,
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-west-2"),
+		S3ForcePathStyle: aws.Bool(true),
+	})))
+}
+
+// stubDecrypter stands in for the S3 encryption client, serving plaintext
+// for every key it holds and recording the keys fetched
+type stubDecrypter struct {
+	plaintext map[string]string
+	fetched   []string
+}
+
+// GetObjectWithContext implements ObjectGetter
+func (sd *stubDecrypter) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	sd.fetched = append(sd.fetched, aws.StringValue(input.Bucket)+"/"+key)
+	body, ok := sd.plaintext[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", key)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestClientSideEncryption(t *testing.T) {
+	decrypter := &stubDecrypter{plaintext: map[string]string{
+		"a.log": "one hit\nmiss\n",
+		"b.gz":  gzipped(t, "two hit\n", 0),
+	}}
+	tests := []struct {
+		key     string
+		want    string
+		matches int
+	}{
+		{"a.log", "one hit\n", 1},
+		{"b.gz", "two hit\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			mj, output := newTestJob(nil, "hit")
+			mj.Context.ClientSideEncryption = aws.Bool(true)
+			mj.Context.Decrypter = decrypter
+			matches, err := mj.SearchObject(context.Background(), ObjectInfo{Key: tt.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := output.String(); got != tt.want || matches != tt.matches {
+				t.Errorf("found %d matches %q, want %d %q", matches, got, tt.matches, tt.want)
+			}
+		})
+	}
+	if got, want := strings.Join(decrypter.fetched, ","), "bucket/a.log,bucket/b.gz"; got != want {
+		t.Errorf("decrypter fetched %s, want %s", got, want)
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, key := range []string{"a/1.log", "a/2.log", "b/1.log"} {
+		name := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(key+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source, err := OpenSource("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"a/1.log", "a/2.log", "b/1.log"}},
+		{"a/", []string{"a/1.log", "a/2.log"}},
+		{"b/1", []string{"b/1.log"}},
+		{"c/", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for obj := range source.List(context.Background(), tt.prefix) {
+			if obj.Err != nil {
+				t.Fatal(obj.Err)
+			}
+			got = append(got, obj.Key)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "outside.log"), []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(filepath.Dir(dir), "outside.log"))
+	gets := []struct {
+		key  string
+		want string
+	}{
+		{"a/1.log", "a/1.log\n"},
+		{"a/../b/1.log", "b/1.log\n"},
+		{"/a/2.log", "a/2.log\n"},
+		{"../outside.log", ""},
+		{"a/../../outside.log", ""},
+		{"..", ""},
+	}
+	for _, tt := range gets {
+		body, err := source.Get(context.Background(), tt.key)
+		if tt.want == "" {
+			if err == nil {
+				body.Close()
+				t.Errorf("Get(%q) read outside the directory", tt.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Get(%q): %v", tt.key, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil || string(data) != tt.want {
+			t.Errorf("Get(%q) = %q, %v, want %q", tt.key, data, err, tt.want)
+		}
+	}
+}
+
+func TestSearchDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"plain.log": "one hit\nmiss\n",
+		"zipped.gz": gzipped(t, "two hit\nthree hit\n", 0),
+		"empty.log": "",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source, err := OpenSource("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mj, output := newTestJob(source, "hit")
+	mj.ShowKeys = true
+	summary, err := mj.Search(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output.String(), "plain.log:one hit\nzipped.gz:two hit\nzipped.gz:three hit\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	if summary.Objects != 2 || summary.Matches != 3 {
+		t.Errorf("searched %d objects with %d matches, want 2 with 3", summary.Objects, summary.Matches)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Summary describes the outcome of a search. Bytes is the stored size of the
+// objects searched, and DecompressedBytes the amount of content scanned once
+// decompressed. Errors holds a "key: reason" entry for each object which
+// could not be searched, and Warnings counts objects which were skipped or
+// only partly searched
+type Summary struct {
+	Objects           int               `json:"objects"`
+	Bytes             int64             `json:"bytes"`
+	DecompressedBytes int64             `json:"decompressed_bytes"`
+	Matches           int               `json:"matches"`
+	Errors            []string          `json:"errors"`
+	Warnings          int               `json:"warnings"`
+	ElapsedSeconds    float64           `json:"elapsed_seconds"`
+	KeyMatches        map[string]int    `json:"key_matches"`
+	GroupMatches      map[string]int    `json:"group_matches,omitempty"`
+	LineStats         *LineLengthReport `json:"line_stats,omitempty"`
+}
+
+// NewSummary initialises an empty Summary
+func NewSummary() *Summary {
+	return &Summary{Errors: []string{}, KeyMatches: map[string]int{}}
+}
+
+// Add accumulates the totals and errors of another summary
+func (s *Summary) Add(other *Summary) {
+	s.Objects += other.Objects
+	s.Bytes += other.Bytes
+	s.Matches += other.Matches
+	s.Errors = append(s.Errors, other.Errors...)
+}
+
+// WriteJSON writes the summary to a file as a single JSON document
+func (s *Summary) WriteJSON(filename string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}